@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// cborMaxDepth limits nesting of decoded items, WebAuthn structures are shallow
+const cborMaxDepth = 16
+
+var errCBORTruncated = errors.New("cbor: truncated data")
+
+// decodeCBOR decodes the first item of data, a subset of RFC 8949 used by WebAuthn:
+// integers (as int64), byte and text strings, arrays ([]any), maps (map[any]any)
+// and simple values. Returns the item and the data following it
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nesting is too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// simple values and floats have their own encoding of the argument
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(data) >= 1:
+		arg, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		arg, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		arg, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		arg, data = binary.BigEndian.Uint64(data), data[8:]
+	case info < 28:
+		return nil, nil, errCBORTruncated
+	default:
+		return nil, nil, errors.New("cbor: indefinite lengths are not supported")
+	}
+
+	switch major {
+	case 0, 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		if major == 1 {
+			return -1 - int64(arg), data, nil
+		}
+		return int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+	case 4:
+		// every item takes at least a byte, so a longer array can't be valid
+		if arg > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, data = append(items, item), rest
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, rest, err := decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: only integer and text map keys are supported")
+			}
+			value, rest, err := decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], data = value, rest
+		}
+		return m, data, nil
+	}
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeCBOR encodes the subset of CBOR decodeCBOR supports, for software authenticators in tests
+func encodeCBOR(v any) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg <= 0xff:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+		case arg <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, arg)
+	}
+
+	switch v := v.(type) {
+	case int:
+		return encodeCBOR(int64(v))
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	case []any:
+		out := head(4, uint64(len(v)))
+		for _, item := range v {
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	case map[any]any:
+		out := head(5, uint64(len(v)))
+		for k, item := range v {
+			out = append(out, encodeCBOR(k)...)
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	}
+	panic("unsupported cbor value")
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	value := map[any]any{
+		int64(1):  int64(2),
+		int64(-3): []byte{1, 2, 3},
+		"fmt":     "none",
+		"list":    []any{int64(0), int64(23), int64(24), int64(-1000), int64(1 << 40), true, false, nil},
+		"nested":  map[any]any{"authData": make([]byte, 300)},
+	}
+	data := append(encodeCBOR(value), 0xaa, 0xbb)
+	decoded, rest, err := decodeCBOR(data)
+	assert.NoError(t, err)
+	assert.Equal(t, any(value), decoded)
+	assert.Equal(t, []byte{0xaa, 0xbb}, rest)
+
+	// RFC 8949 appendix A examples
+	decoded, _, err = decodeCBOR([]byte{0x39, 0x03, 0xe7})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1000), decoded)
+	decoded, _, err = decodeCBOR([]byte{0x64, 0x49, 0x45, 0x54, 0x46})
+	assert.NoError(t, err)
+	assert.Equal(t, "IETF", decoded)
+
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"truncated bytes":   {0x45, 0x01},
+		"truncated length":  {0x19, 0x01},
+		"truncated map":     {0xa2, 0x01, 0x02},
+		"huge array":        {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite length": {0x5f, 0x41, 0x01, 0xff},
+		"tag":               {0xc1, 0x01},
+		"float":             {0xf9, 0x3c, 0x00},
+		"array key":         {0xa1, 0x80, 0x01},
+	} {
+		_, _, err := decodeCBOR(data)
+		assert.Error(t, err, name)
+	}
+
+	deep := []byte{}
+	for i := 0; i < 100; i++ {
+		deep = append(deep, 0x81)
+	}
+	_, _, err = decodeCBOR(append(deep, 0x01))
+	assert.Error(t, err)
+}
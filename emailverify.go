@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"time"
+)
+
+const (
+	ErrEmailInvalid             = "invalid email address"
+	ErrEmailRequired            = "email is required"
+	ErrEmailNotVerified         = "email is not verified"
+	ErrEmailVerificationInvalid = "invalid email verification token"
+)
+
+// emailVerificationPurpose marks tokens good for VerifyEmail only
+const emailVerificationPurpose = "verify-email"
+
+// UnverifiedPolicy decides what users with an unverified email get on signin
+type UnverifiedPolicy string
+
+const (
+	// UnverifiedAllow signs unverified users in as usual, the default
+	UnverifiedAllow UnverifiedPolicy = "allow"
+	// UnverifiedRestrict issues access tokens without roles and with UnverifiedScopes
+	// only, so role and scope checks and policies on roles or scopes reject them.
+	// Principals keep their attributes, deny rules on attributes apply as to anyone
+	UnverifiedRestrict UnverifiedPolicy = "restrict"
+	// UnverifiedReject refuses to issue access tokens with ErrEmailNotVerified
+	UnverifiedReject UnverifiedPolicy = "reject"
+)
+
+// ParseUnverifiedPolicy - parses a policy name, e.g. of a command line flag
+func ParseUnverifiedPolicy(name string) (UnverifiedPolicy, error) {
+	switch p := UnverifiedPolicy(name); p {
+	case UnverifiedAllow, UnverifiedRestrict, UnverifiedReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown unverified email policy %q", name)
+}
+
+// EmailVerification sets the policy for users with an unverified email, and
+// the scopes of restricted tokens. Signup requires an email unless the policy
+// is UnverifiedAllow
+func EmailVerification(policy UnverifiedPolicy, scopes ...string) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Unverified = policy
+		s.UnverifiedScopes = scopes
+	}
+}
+
+// unverified checks if a user has an email waiting for verification,
+// users without an email aren't subject to verification
+func (s *AuthService) unverified(user *User) bool {
+	return user.Email != "" && !user.EmailVerified
+}
+
+// parseEmail checks an address is a bare address, without a display name
+func parseEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New(ErrEmailInvalid)
+	}
+	return nil
+}
+
+// SignupEmail - creates a user with a given login, password and email, and mails
+// a verification link if the mailer is configured. A failure to send the link
+// is logged only, the user can ask for another one with SendEmailVerification
+func (s *AuthService) SignupEmail(ctx context.Context, login, password, email string) error {
+	if email == "" {
+		if s.Unverified != UnverifiedAllow {
+			return errors.New(ErrEmailRequired)
+		}
+		_, err := s.Signup(login, password)
+		return err
+	}
+	if err := parseEmail(email); err != nil {
+		return err
+	}
+	if err := s.checkPassword(login, password); err != nil {
+		return err
+	}
+
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	if err := s.Users.Create(User{Login: login, Password: hash, Email: email}); err != nil {
+		return err
+	}
+
+	if s.Mailer != nil {
+		if err := s.SendEmailVerification(ctx, login); err != nil {
+			log.Printf("[WARN] failed to send email verification to %s, %v", login, err)
+		}
+	}
+	return nil
+}
+
+// SendEmailVerification - mails a verification link to the email of a user.
+// Unknown logins and users without an unverified email are ignored without
+// an error, HandleVerifyEmailResend sends it in the background not to tell logins apart
+func (s *AuthService) SendEmailVerification(ctx context.Context, login string) error {
+	if s.Mailer == nil {
+		return errors.New(ErrMailerNotConfigured)
+	}
+	user, err := s.Users.Get(login)
+	if err != nil {
+		if err.Error() == ErrUserNotFound {
+			return nil
+		}
+		return err
+	}
+	if !s.unverified(user) {
+		return nil
+	}
+
+	token, err := s.Tokens.New(user.Login, WithPurpose(emailVerificationPurpose),
+		WithExpiresAt(time.Now().Add(s.EmailVerificationTTL)))
+	if err != nil {
+		return err
+	}
+	link := s.BaseURL + "/verify-email?token=" + url.QueryEscape(token.Token)
+	return s.Mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Verify your email for " + s.Realm,
+		Body: fmt.Sprintf("Follow the link to verify %s as the email of %s:\n\n%s\n\nThe link expires at %s.\n"+
+			"If you didn't sign up, ignore this message.\n", user.Email, user.Login, link, token.ExpiresAt.Format(time.RFC1123)),
+	})
+}
+
+// VerifyEmail - marks the email of a user verified with the token of a verification
+// link, returns the login. Verifying an already verified email is a no-op
+func (s *AuthService) VerifyEmail(token string) (string, error) {
+	validated, err := s.Tokens.Validate(token)
+	if err != nil || validated.Purpose != emailVerificationPurpose {
+		return "", errors.New(ErrEmailVerificationInvalid)
+	}
+
+	err = s.updateUser(validated.Login, func(u *User) bool {
+		if !s.unverified(u) {
+			return false
+		}
+		u.EmailVerified = true
+		return true
+	})
+	if err != nil {
+		if err.Error() == ErrUserNotFound {
+			return "", errors.New(ErrEmailVerificationInvalid)
+		}
+		return "", err
+	}
+	return validated.Login, nil
+}
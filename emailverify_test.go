@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerification(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth"), EmailVerification(UnverifiedReject))
+	ctx := context.Background()
+
+	assert.EqualError(t, service.SignupEmail(ctx, "user1", "password1", ""), ErrEmailRequired)
+	assert.EqualError(t, service.SignupEmail(ctx, "user1", "password1", "User <user1@example.com>"), ErrEmailInvalid)
+	assert.NoError(t, service.SignupEmail(ctx, "user1", "password1", "user1@example.com"))
+	assert.Len(t, outbox.Messages(), 1)
+	assert.Equal(t, "user1@example.com", outbox.Messages()[0].To)
+	link := lastLink(t, outbox)
+	assert.Equal(t, "/auth/verify-email", link.Path)
+
+	_, err := service.Signin("user1", "password1")
+	assert.EqualError(t, err, ErrEmailNotVerified)
+
+	// the link token isn't an access token, access tokens aren't verification tokens
+	_, err = service.Authenticate(link.Query().Get("token"))
+	assert.EqualError(t, err, ErrTokenPurpose)
+	other, err := tp.New("user1")
+	assert.NoError(t, err)
+	_, err = service.VerifyEmail(other.Token)
+	assert.EqualError(t, err, ErrEmailVerificationInvalid)
+
+	login, err := service.VerifyEmail(link.Query().Get("token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+	user, err := service.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+	_, err = service.Signin("user1", "password1")
+	assert.NoError(t, err)
+
+	// verified emails and unknown logins get no more mail
+	assert.NoError(t, service.SendEmailVerification(ctx, "user1"))
+	assert.NoError(t, service.SendEmailVerification(ctx, "unknown"))
+	assert.Len(t, outbox.Messages(), 1)
+
+	// users without an email aren't subject to verification
+	_, err = service.Signup("user2", "password2")
+	assert.NoError(t, err)
+	_, err = service.Signin("user2", "password2")
+	assert.NoError(t, err)
+}
+
+func TestUnverifiedPolicies(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	users := NewUsers()
+	service := NewAuthService(tp, users)
+	hash, err := service.Hasher.Hash("password1")
+	assert.NoError(t, err)
+	assert.NoError(t, users.Create(User{Login: "user1", Password: hash, Email: "user1@example.com",
+		Roles: []string{"admin"}, Scopes: []string{"orders:*"}, Attributes: map[string]string{"org": "acme"}}))
+
+	token, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+	p, err := service.Authenticate(token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, p.Roles)
+
+	service = NewAuthService(tp, users, EmailVerification(UnverifiedRestrict, "profile:read"))
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	p, err = service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Empty(t, p.Roles)
+	assert.Equal(t, []string{"profile:read"}, p.Scopes)
+	assert.Equal(t, map[string]string{"org": "acme"}, p.Attributes)
+	// rules on roles don't match it, deny rules on attributes still do
+	e := newTestPolicyEngine(t, "policy.example.yaml")
+	in := PolicyInput{Principal: p, Action: "documents:edit",
+		Resource: Resource{Type: "document", ID: "1", Attributes: map[string]any{"org": "acme", "archived": false}}}
+	assert.False(t, e.Decide(in).Allowed)
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`rules:
+  - id: read-documents
+    effect: allow
+    actions: ["documents:read"]
+  - id: other-orgs
+    effect: deny
+    actions: ["*"]
+    when:
+      - principal.attributes.org != resource.attributes.org
+`), 0o600))
+	e, err = NewPolicyEngine(path)
+	assert.NoError(t, err)
+	in.Action = "documents:read"
+	assert.True(t, e.Decide(in).Allowed)
+	in.Resource.Attributes["org"] = "globex"
+	assert.False(t, e.Decide(in).Allowed)
+	// refreshed tokens stay restricted
+	session, err = service.Refresh(session.Refresh.Token)
+	assert.NoError(t, err)
+	p, err = service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Empty(t, p.Roles)
+
+	outbox := NewOutbox("")
+	service = NewAuthService(tp, users, EmailVerification(UnverifiedReject), Mail(outbox, "https://example.com/auth"))
+	_, err = service.Signin("user1", "password1")
+	assert.EqualError(t, err, ErrEmailNotVerified)
+
+	// following a magic link proves the email
+	assert.NoError(t, service.SendMagicLink(context.Background(), "user1"))
+	assert.Equal(t, "user1@example.com", outbox.Messages()[0].To)
+	_, err = service.MagicLinkSignin(lastLink(t, outbox).Query().Get("token"))
+	assert.NoError(t, err)
+	_, err = service.Signin("user1", "password1")
+	assert.NoError(t, err)
+
+	_, err = ParseUnverifiedPolicy("restrict")
+	assert.NoError(t, err)
+	_, err = ParseUnverifiedPolicy("deny")
+	assert.Error(t, err)
+}
+
+func TestEmailVerificationHandlers(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth"), EmailVerification(UnverifiedReject))
+	handler := service.Handlers("/auth")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/auth/signup", `{"login": "user1", "password": "password1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/auth/signup", `{"login": "user1", "password": "password1", "email": "user1"}`).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/auth/signup", `{"login": "user1", "password": "password1", "email": "user1@example.com"}`).Code)
+	assert.Len(t, outbox.Messages(), 1)
+
+	response := do("POST", "/auth/signin", `{"login": "user1", "password": "password1"}`)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	var status map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&status))
+	assert.Equal(t, "EMAIL_NOT_VERIFIED", status["status"])
+
+	// the same response for existing and unknown logins
+	known, unknown := do("POST", "/auth/verify-email/resend", `{"login": "user1"}`), do("POST", "/auth/verify-email/resend", `{"login": "unknown"}`)
+	service.WaitMail()
+	assert.Equal(t, http.StatusAccepted, known.Code)
+	assert.Equal(t, known.Code, unknown.Code)
+	assert.Equal(t, known.Body.String(), unknown.Body.String())
+	assert.Len(t, outbox.Messages(), 2)
+
+	assert.Equal(t, http.StatusBadRequest, do("GET", "/auth/verify-email?token=invalid", "").Code)
+	assert.Equal(t, http.StatusOK, do("GET", lastLink(t, outbox).RequestURI(), "").Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/auth/signin", `{"login": "user1", "password": "password1"}`).Code)
+
+	service.Mailer = nil
+	assert.Equal(t, http.StatusNotImplemented, do("POST", "/auth/verify-email/resend", `{"login": "user1"}`).Code)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenExtractor finds an access token in a request, returns an empty string if there is none
+type TokenExtractor func(r *http.Request) string
+
+// FromAuthorizationHeader extracts a token from the `Authorization: Bearer <token>` header
+func FromAuthorizationHeader() TokenExtractor {
+	return func(r *http.Request) string {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return ""
+		}
+		return strings.TrimSpace(token)
+	}
+}
+
+// FromCookie extracts a token from a cookie with a given name
+func FromCookie(name string) TokenExtractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// FromQuery extracts a token from a query parameter, RFC 6750 discourages it,
+// as URLs end up in logs and browser history
+func FromQuery(name string) TokenExtractor {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// extractToken returns the token found by the first extractor of the chain
+func (s *AuthService) extractToken(r *http.Request) string {
+	for _, extract := range s.Extractors {
+		if token := extract(r); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// unauthorized responds with 401 and a `WWW-Authenticate` challenge per RFC 6750,
+// the error is reported only if a token was presented. The client gets a fixed
+// description, details like an unknown login are logged only
+func (s *AuthService) unauthorized(w http.ResponseWriter, err error) {
+	challenge := fmt.Sprintf("Bearer realm=%q", s.Realm)
+	if err != nil {
+		log.Printf("[DEBUG] token rejected, %v", err)
+		description := "invalid token"
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			description = "token expired"
+		}
+		challenge += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+}
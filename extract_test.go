@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExtractors(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/?access_token=query_token", nil)
+	req.Header.Set("Authorization", "bearer header_token")
+	req.Header.Set("Cookie", "token=cookie_token")
+
+	assert.Equal(t, "header_token", FromAuthorizationHeader()(req))
+	assert.Equal(t, "cookie_token", FromCookie("token")(req))
+	assert.Equal(t, "query_token", FromQuery("access_token")(req))
+	assert.Empty(t, FromCookie("other")(req))
+
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	assert.Empty(t, FromAuthorizationHeader()(req))
+	req.Header.Set("Authorization", "Bearer")
+	assert.Empty(t, FromAuthorizationHeader()(req))
+}
+
+func TestAuthMiddlewareBearer(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	authService := NewAuthService(tp, NewUsers())
+	_, err := authService.Signup("user1", "password1")
+	assert.NoError(t, err)
+	token, err := authService.Signin("user1", "password1")
+	assert.NoError(t, err)
+
+	handler := authService.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Members only area, congrats!"))
+	}))
+
+	// bearer token
+	req, _ := http.NewRequest("GET", "/membersonly", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// cookie
+	req, _ = http.NewRequest("GET", "/membersonly", nil)
+	req.Header.Set("Cookie", "token="+token)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// no token, challenge without error
+	req, _ = http.NewRequest("GET", "/membersonly", nil)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, `Bearer realm="auth"`, response.Header().Get("WWW-Authenticate"))
+
+	// invalid token
+	req, _ = http.NewRequest("GET", "/membersonly", nil)
+	req.Header.Set("Authorization", "Bearer invalid_token")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, `Bearer realm="auth", error="invalid_token", error_description="invalid token"`, response.Header().Get("WWW-Authenticate"))
+
+	// expired token
+	expired, err := tp.New("user1", WithExpiresAt(time.Now().Add(-time.Minute)))
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+expired.Token)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, `Bearer realm="auth", error="invalid_token", error_description="token expired"`, response.Header().Get("WWW-Authenticate"))
+
+	// a token of an unknown login doesn't tell the login doesn't exist
+	unknown, err := tp.New("unknown")
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+unknown.Token)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, `Bearer realm="auth", error="invalid_token", error_description="invalid token"`, response.Header().Get("WWW-Authenticate"))
+
+	// query parameter is accepted only if configured
+	req, _ = http.NewRequest("GET", "/membersonly?access_token="+token, nil)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	authService = NewAuthService(tp, authService.Users, TokenExtractors(FromAuthorizationHeader(), FromQuery("access_token")))
+	response = httptest.NewRecorder()
+	authService.Auth(http.NotFoundHandler()).ServeHTTP(response, req)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// check endpoint with a bearer token
+	req, _ = http.NewRequest("GET", "/auth/check", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response = httptest.NewRecorder()
+	authService.HandleCheck(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"login":"user1"`)
+	assert.Contains(t, response.Body.String(), `"ExpiresAt"`)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileUsers is a UserProvider persisting users in a json file, the file
+// is rewritten atomically on every change, so it survives crashes
+type FileUsers struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// fileUser is a User as stored in the file, password hashes are binary
+// and can't be kept in a json string as is
+type fileUser struct {
+	User
+	Password []byte `json:"password"`
+}
+
+// NewFileUsers - loads users from a given file, the file is created on the first change.
+// Temporary files left by an interrupted write are removed, the file itself
+// always holds the last complete write
+func NewFileUsers(path string) (*FileUsers, error) {
+	u := &FileUsers{path: path, users: make(map[string]User)}
+
+	leftovers, err := filepath.Glob(filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range leftovers {
+		os.Remove(f)
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []fileUser
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		user := r.User
+		user.Password = string(r.Password)
+		u.users[user.Login] = user
+	}
+	return u, nil
+}
+
+func (u *FileUsers) Get(login string) (*User, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	user, ok := u.users[login]
+	if !ok {
+		return nil, errors.New(ErrUserNotFound)
+	}
+	user = user.clone()
+	return &user, nil
+}
+
+func (u *FileUsers) Create(user User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.users[user.Login]; ok {
+		return &UserExistsError{Login: user.Login}
+	}
+	u.users[user.Login] = user.clone()
+	return u.saveOrRestore(user.Login, User{}, false)
+}
+
+func (u *FileUsers) Update(user User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	prev, ok := u.users[user.Login]
+	if !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	u.users[user.Login] = user.clone()
+	return u.saveOrRestore(user.Login, prev, true)
+}
+
+func (u *FileUsers) Modify(login string, change func(*User) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	prev, ok := u.users[login]
+	if !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	user := prev.clone()
+	if err := change(&user); err != nil {
+		return err
+	}
+	u.users[login] = user
+	return u.saveOrRestore(login, prev, true)
+}
+
+func (u *FileUsers) Delete(login string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	prev, ok := u.users[login]
+	if !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	delete(u.users, login)
+	return u.saveOrRestore(login, prev, true)
+}
+
+func (u *FileUsers) List(offset, limit int) ([]User, int, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	users, total := paginate(u.users, offset, limit)
+	return users, total, nil
+}
+
+func (u *FileUsers) Exists(login string) (bool, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.users[login]
+	return ok, nil
+}
+
+// saveOrRestore saves users, restoring the previous state of a changed user
+// if the write fails, so memory stays in sync with the file.
+// Must be called with the lock held
+func (u *FileUsers) saveOrRestore(login string, prev User, existed bool) error {
+	err := u.save()
+	if err == nil {
+		return nil
+	}
+	if existed {
+		u.users[login] = prev
+	} else {
+		delete(u.users, login)
+	}
+	return err
+}
+
+// save writes all users to the file, must be called with the lock held
+func (u *FileUsers) save() error {
+	records := make([]fileUser, 0, len(u.users))
+	for _, user := range u.users {
+		records = append(records, fileUser{User: user, Password: []byte(user.Password)})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Login < records[j].Login })
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(u.path, data, 0o600)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileUsersRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+
+	up, err := NewFileUsers(path)
+	assert.NoError(t, err)
+	_, err = NewAuthService(tp, up).Signup("login", "password")
+	assert.NoError(t, err)
+
+	// users survive a restart
+	up, err = NewFileUsers(path)
+	assert.NoError(t, err)
+	service := NewAuthService(tp, up)
+
+	token, err := service.Signin("login", "password")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	token, err = service.Signin("login", "wrong password")
+	assert.Error(t, err)
+	assert.Empty(t, token)
+}
+
+func TestFileUsersRecovery(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+
+	up, err := NewFileUsers(path)
+	assert.NoError(t, err)
+	assert.NoError(t, up.Create(User{Login: "user1", Password: "hash1"}))
+
+	// a write interrupted before the rename leaves a temporary file behind
+	leftover := filepath.Join(dir, ".users.json.tmp-123")
+	assert.NoError(t, os.WriteFile(leftover, []byte(`[{"login":`), 0o600))
+
+	up, err = NewFileUsers(path)
+	assert.NoError(t, err)
+	user, err := up.Get("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash1", user.Password)
+
+	_, err = os.Stat(leftover)
+	assert.True(t, os.IsNotExist(err))
+
+	// corrupted file is reported, not silently replaced
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = NewFileUsers(path)
+	assert.Error(t, err)
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type Credentials struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// Email is optional, on signup only
+	Email string `json:"email,omitempty"`
 }
 
 // HandleSignin - http handler for /signin endpoint, signs in a user
@@ -22,33 +29,487 @@ func (s *AuthService) HandleSignin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	expectedUser, err := s.Users.Get(creds.Login)
+	session, err := s.SigninSessionFrom(clientIP(r), creds.Login, creds.Password)
+	if err != nil {
+		if writeLockedError(w, err) {
+			return
+		}
+		// If the username/password combination is wrong, return an error
+		if isCredentialsError(err) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err.Error() == ErrEmailNotVerified {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"status": "EMAIL_NOT_VERIFIED", "login": creds.Login})
+			return
+		}
+		log.Printf("[ERROR] failed to sign in %s, %v", creds.Login, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s.writeSigninResult(w, session)
+}
+
+// writeSigninResult writes a session, or an mfa token if the first factor
+// is passed, but the user has to complete mfa with /mfa/verify
+func (s *AuthService) writeSigninResult(w http.ResponseWriter, session *Session) {
+	if session.MFA != nil {
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":     "MFA_REQUIRED",
+			"login":      session.MFA.Login,
+			"mfa_token":  session.MFA.Token,
+			"expires_at": session.MFA.ExpiresAt.Format(time.RFC3339),
+		})
+		return
+	}
+	writeSession(w, session)
+}
+
+// HandleMagicLink - http handler for /magic-link endpoint, mails a signin link
+// for {"login": ...}. Responds the same whether the login exists or not
+func (s *AuthService) HandleMagicLink(w http.ResponseWriter, r *http.Request) {
+	if s.Mailer == nil || s.MagicLinks == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mailInBackground(r, "magic link", req.Login, s.SendMagicLink)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+}
+
+// HandleMagicLinkVerify - http handler for /magic-link/verify endpoint, the link
+// in the message. GET renders a page confirming the signin, so link scanners
+// of mail services don't use the link up. POST signs in with the token
+// form value or query parameter, responds the same way as HandleSignin
+func (s *AuthService) HandleMagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if r.Method != http.MethodPost {
+		login, err := s.MagicLinkLogin(token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// the page holds the token, it isn't cached or leaked to other sites
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		err = magicLinkPage.Execute(w, map[string]string{"Realm": s.Realm, "Login": login, "Token": token})
+		if err != nil {
+			log.Printf("[ERROR] failed to render magic link page, %v", err)
+		}
+		return
+	}
+
+	session, err := s.MagicLinkSignin(token)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.writeSigninResult(w, session)
+}
+
+// magicLinkPage confirms a signin with a magic link, the form posts the token back
+var magicLinkPage = template.Must(template.New("magic-link").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.Realm}}</title></head>
+<body>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Sign in to {{.Realm}} as {{.Login}}</button>
+</form>
+</body>
+</html>
+`))
+
+// HandleVerifyEmail - http handler for /verify-email endpoint, the link in the
+// verification message. Takes the token query parameter or {"token": ...}
+func (s *AuthService) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" && r.Method == http.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+
+	login, err := s.VerifyEmail(token)
+	if err != nil {
+		if err.Error() == ErrEmailVerificationInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("[ERROR] failed to verify email, %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": login})
+}
+
+// HandleVerifyEmailResend - http handler for /verify-email/resend endpoint, mails
+// another verification link for {"login": ...}. Responds the same whether
+// the login exists or not
+func (s *AuthService) HandleVerifyEmailResend(w http.ResponseWriter, r *http.Request) {
+	if s.Mailer == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mailInBackground(r, "email verification", req.Login, s.SendEmailVerification)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+}
+
+// HandlePasswordForgot - http handler for /password/forgot endpoint, mails
+// a password reset link for {"login": ...}. Responds the same whether
+// the login exists or not
+func (s *AuthService) HandlePasswordForgot(w http.ResponseWriter, r *http.Request) {
+	if s.Mailer == nil || s.ResetTokens == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var req struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Login == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mailInBackground(r, "password reset", req.Login, s.ForgotPassword)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+}
+
+// HandlePasswordReset - http handler for /password/reset endpoint, sets
+// a new password with {"token": ..., "password": ...}, the token may be passed
+// in the query of the link instead. The user is logged out everywhere
+func (s *AuthService) HandlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		req.Token = r.URL.Query().Get("token")
+	}
+
+	login, err := s.ResetPassword(req.Token, req.Password)
+	if err != nil {
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if err.Error() == ErrResetTokenInvalid {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("[ERROR] failed to reset password, %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": login})
+}
+
+// HandlePasswordChange - http handler for /password/change endpoint, replaces the
+// caller's password with {"current_password": ..., "password": ..., "logout_others": ...}.
+// With logout_others the caller gets a new session the same way as with HandleSignin
+func (s *AuthService) HandlePasswordChange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+		LogoutOthers    bool   `json:"logout_others"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p, _ := PrincipalFromContext(r.Context())
+	session, err := s.ChangePasswordFrom(clientIP(r), p.Login, req.CurrentPassword, req.Password, req.LogoutOthers)
+	if err != nil {
+		if writeLockedError(w, err) {
+			return
+		}
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if err.Error() == ErrWrongPassword {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		log.Printf("[ERROR] failed to change password of %s, %v", p.Login, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if session != nil {
+		writeSession(w, session)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": p.Login})
+}
+
+// HandleMFAVerify - http handler for /mfa/verify endpoint, exchanges
+// {"mfa_token": ..., "code": ...} for a session, the code is either a TOTP code
+// or a recovery code. Responds the same way as HandleSignin, with 429 once
+// too many wrong codes lock the login out
+func (s *AuthService) HandleMFAVerify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	session, err := s.VerifyMFAFrom(clientIP(r), req.MFAToken, req.Code)
+	if err != nil {
+		if writeLockedError(w, err) {
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeSession(w, session)
+}
+
+// HandleTOTPEnroll - http handler for /mfa/totp/enroll endpoint, generates a pending
+// TOTP secret for the caller, responds with the secret and its otpauth:// URI
+func (s *AuthService) HandleTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	enrollment, err := s.EnrollTOTP(p.Login)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// HandleTOTPQRCode - http handler for /mfa/totp/qr endpoint, renders the
+// pending enrollment of the caller as a PNG QR code
+func (s *AuthService) HandleTOTPQRCode(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	enrollment, err := s.PendingTOTP(p.Login)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	png, err := enrollment.QRCode(256)
+	if err != nil {
+		log.Printf("[ERROR] failed to render qr code for %s, %v", p.Login, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(png)
+}
+
+// HandleTOTPConfirm - http handler for /mfa/totp/confirm endpoint, enables
+// the pending TOTP secret of the caller with a first {"code": ...},
+// responds with recovery codes
+func (s *AuthService) HandleTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	codes, err := s.ConfirmTOTP(p.Login, req.Code)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": "OK", "login": p.Login, "recovery_codes": codes})
+}
+
+// HandleRecoveryCodes - http handler for /mfa/recovery-codes endpoint, replaces
+// recovery codes of the caller, the old codes stop working
+func (s *AuthService) HandleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, _ := PrincipalFromContext(r.Context())
+	codes, err := s.RegenerateRecoveryCodes(p.Login)
+	if err != nil {
+		writeTOTPError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"status": "OK", "login": p.Login, "recovery_codes": codes})
+}
+
+// writeTOTPError maps TOTP enrollment errors to http statuses
+func writeTOTPError(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case ErrTOTPNotEnrolled:
+		w.WriteHeader(http.StatusNotFound)
+	case ErrTOTPEnrolled:
+		w.WriteHeader(http.StatusConflict)
+	case ErrTOTPInvalidCode:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		log.Printf("[ERROR] totp enrollment failed, %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
 
-	// If the username/password combination is wrong, return an error
-	if err != nil || expectedUser.Password != creds.Password {
+// HandleRefresh - http handler for /refresh endpoint, exchanges a refresh token
+// from a json body or the refresh_token cookie for a new session, responds
+// the same way as HandleSignin
+func (s *AuthService) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if req.RefreshToken == "" {
+		if c, err := r.Cookie("refresh_token"); err == nil {
+			req.RefreshToken = c.Value
+		}
+	}
+	if req.RefreshToken == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	token, err := s.Tokens.New(creds.Login)
+	session, err := s.Refresh(req.RefreshToken)
 	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeSession(w, session)
+}
+
+// writeLockedError responds 429 with a `Retry-After` header to attempts of
+// a locked out login or IP, returns false if the error is of other kind
+func writeLockedError(w http.ResponseWriter, err error) bool {
+	var locked *LockedError
+	if !errors.As(err, &locked) {
+		return false
+	}
+	retryAfter := locked.RetryAfter()
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]any{"status": "LOCKED", "retry_after": retryAfter})
+	return true
+}
+
+// HandleUnlock - http handler for /unlock endpoint, for admins only. Forgets failed
+// signin attempts of {"login": ..., "ip": ...}, either of them may be omitted
+func (s *AuthService) HandleUnlock(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+		IP    string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Login == "" && req.IP == "") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := s.UnlockSignin(req.Login, req.IP); err != nil {
+		log.Printf("[ERROR] failed to unlock signin of %q from %q, %v", req.Login, req.IP, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+}
 
+// writePasswordPolicyError responds 400 with violations of the password policy,
+// returns false if the error is of other kind
+func writePasswordPolicyError(w http.ResponseWriter, err error) bool {
+	var weak *PasswordPolicyError
+	if !errors.As(err, &weak) {
+		return false
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "WEAK_PASSWORD",
+		"violations": weak.Violations,
+		"strength":   weak.Strength,
+	})
+	return true
+}
+
+// isCredentialsError checks if a signin error is caused by a wrong login or password
+func isCredentialsError(err error) bool {
+	return err.Error() == ErrUserNotFound || err.Error() == ErrWrongPassword
+}
+
+// writeSession sets token cookies and writes a json encoded struct with
+// status, login, tokens and their expiration times
+func writeSession(w http.ResponseWriter, session *Session) {
 	http.SetCookie(w, &http.Cookie{
 		Path:    "/",
 		Name:    "token",
-		Value:   token.Token,
-		Expires: token.ExpiresAt,
+		Value:   session.Access.Token,
+		Expires: session.Access.ExpiresAt,
 	})
-	// w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "token": token.Token, "expires_at": token.ExpiresAt.Format(time.RFC3339)})
+	resp := map[string]string{
+		"status":     "OK",
+		"login":      session.Access.Login,
+		"token":      session.Access.Token,
+		"expires_at": session.Access.ExpiresAt.Format(time.RFC3339),
+	}
+
+	if session.Refresh != nil {
+		http.SetCookie(w, &http.Cookie{
+			Path:     "/",
+			Name:     "refresh_token",
+			Value:    session.Refresh.Token,
+			Expires:  session.Refresh.ExpiresAt,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		resp["refresh_token"] = session.Refresh.Token
+		resp["refresh_expires_at"] = session.Refresh.ExpiresAt.Format(time.RFC3339)
+	}
+
+	json.NewEncoder(w).Encode(resp)
 }
 
 // HandleSignup - http handler for /signup endpoint, creates a new user,
-// sets a cookie with a json encoded struct with status and a username
+// sets a cookie with a json encoded struct with status and a username.
+// An optional email gets a verification link, if the mailer is configured
 func (s *AuthService) HandleSignup(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
 	err := json.NewDecoder(r.Body).Decode(&creds)
@@ -57,7 +518,23 @@ func (s *AuthService) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.Users.Create(User(creds))
+	if err := s.SignupEmail(r.Context(), creds.Login, creds.Password, creds.Email); err != nil {
+		var exists *UserExistsError
+		if errors.As(err, &exists) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if writePasswordPolicyError(w, err) {
+			return
+		}
+		if err.Error() == ErrEmailInvalid || err.Error() == ErrEmailRequired {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("[ERROR] failed to create user %s, %v", creds.Login, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": creds.Login})
 }
@@ -65,42 +542,290 @@ func (s *AuthService) HandleSignup(w http.ResponseWriter, r *http.Request) {
 // HandleCheck - http handler for /check endpoint, checks if the token is valid,
 // returns a json encoded struct with status, username and expiration time
 func (s *AuthService) HandleCheck(w http.ResponseWriter, r *http.Request) {
-	c, err := r.Cookie("token")
+	token := s.extractToken(r)
+	if token == "" {
+		s.unauthorized(w, nil)
+		return
+	}
+
+	p, err := s.Authenticate(token)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		s.unauthorized(w, err)
 		return
 	}
 
-	login, err := s.Check(c.Value)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": p.Login, "ExpiresAt": p.ExpiresAt.Format(time.RFC3339)})
+}
+
+// HandleDownscope - http handler for /downscope endpoint, mints a token with
+// a subset of scopes of the caller's token, requested as {"scopes": [...]}.
+// Downscoped tokens can't mint tokens themselves
+func (s *AuthService) HandleDownscope(w http.ResponseWriter, r *http.Request) {
+	token := s.extractToken(r)
+	if token == "" {
+		s.unauthorized(w, nil)
+		return
+	}
+	p, err := s.Authenticate(token)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		s.unauthorized(w, err)
+		return
+	}
+	if p.Downscoped {
+		writeDownscoped(w)
 		return
 	}
 
-	validated, err := s.Tokens.Validate(c.Value)
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	downscoped, err := s.downscope(p, req.Scopes)
 	if err != nil {
+		var notGranted *ScopeNotGrantedError
+		if errors.As(err, &notGranted) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_scope", "scope": notGranted.Scope})
+			return
+		}
+		log.Printf("[ERROR] failed to downscope a token of %s, %v", p.Login, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": login, "ExpiresAt": validated.ExpiresAt.Format(time.RFC3339)})
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     "OK",
+		"login":      downscoped.Login,
+		"token":      downscoped.Token,
+		"expires_at": downscoped.ExpiresAt.Format(time.RFC3339),
+		"scopes":     downscoped.Scopes,
+	})
+}
+
+// HandleAuthorize - http handler for /authorize endpoint, a decision point for
+// other services. Decides on {"action": ..., "resource": {...}, "request": {...}}
+// for the caller's token, the request attributes override the ones of the call itself,
+// except the time ones, `time`, `hour` and `weekday` are always the server's
+func (s *AuthService) HandleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if s.Policy == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	token := s.extractToken(r)
+	if token == "" {
+		s.unauthorized(w, nil)
+		return
+	}
+	p, err := s.Authenticate(token)
+	if err != nil {
+		s.unauthorized(w, err)
+		return
+	}
+
+	var req struct {
+		Action   string         `json:"action"`
+		Resource Resource       `json:"resource"`
+		Request  map[string]any `json:"request"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Action == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	attrs := requestAttributes(r)
+	for k, v := range req.Request {
+		attrs[k] = v
+	}
+	decision := s.Policy.Decide(PolicyInput{Principal: p, Action: req.Action, Resource: req.Resource, Request: attrs})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(decision)
+}
+
+// HandlePasskeyRegisterBegin - http handler for /webauthn/register/begin endpoint,
+// responds with options for navigator.credentials.create()
+func (s *AuthService) HandlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	opts, err := s.BeginPasskeyRegistration(p.Login)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(opts)
 }
 
-// HandleLogout - http handler for logout, clears the token cookie
+// HandlePasskeyRegisterFinish - http handler for /webauthn/register/finish endpoint,
+// stores the credential created by navigator.credentials.create()
+func (s *AuthService) HandlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFromContext(r.Context())
+	var resp RegistrationResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	cred, err := s.FinishPasskeyRegistration(p.Login, resp)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":        "OK",
+		"login":         p.Login,
+		"credential_id": base64.RawURLEncoding.EncodeToString(cred.ID),
+	})
+}
+
+// HandlePasskeyLoginBegin - http handler for /webauthn/login/begin endpoint, takes
+// an optional {"login": ...} and responds with options for navigator.credentials.get()
+func (s *AuthService) HandlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Login string `json:"login"`
+	}
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	opts, err := s.BeginPasskeyLogin(req.Login)
+	if err != nil {
+		writeWebAuthnError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(opts)
+}
+
+// HandlePasskeyLoginFinish - http handler for /webauthn/login/finish endpoint, verifies
+// the assertion made by navigator.credentials.get(), responds the same way as HandleSignin
+func (s *AuthService) HandlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var resp AssertionResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	session, err := s.FinishPasskeyLogin(resp)
+	if err != nil {
+		if err.Error() == ErrWebAuthnNotConfigured {
+			writeWebAuthnError(w, err)
+			return
+		}
+		log.Printf("[DEBUG] passkey login failed, %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeSession(w, session)
+}
+
+// writeWebAuthnError maps ceremony errors to http statuses
+func writeWebAuthnError(w http.ResponseWriter, err error) {
+	switch err.Error() {
+	case ErrWebAuthnNotConfigured:
+		w.WriteHeader(http.StatusNotImplemented)
+	case ErrCredentialExists:
+		w.WriteHeader(http.StatusConflict)
+	case ErrUserNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		log.Printf("[DEBUG] webauthn ceremony failed, %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// HandleLogout - http handler for logout, revokes the access and the refresh tokens
+// and clears their cookies
 func (s *AuthService) Logout(w http.ResponseWriter, r *http.Request) {
-	// immediately clear the token cookie
+	if token := s.extractToken(r); token != "" {
+		if err := s.RevokeToken(token); err != nil {
+			log.Printf("[DEBUG] failed to revoke token, %v", err)
+		}
+	}
+	if c, err := r.Cookie("refresh_token"); err == nil && s.RefreshTokens != nil {
+		if err := s.RefreshTokens.Revoke(c.Value); err != nil {
+			log.Printf("[WARN] failed to revoke refresh token, %v", err)
+		}
+	}
+
+	clearCookies(w)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+}
+
+// HandleLogoutAll - http handler for /logout/all endpoint, revokes every token
+// issued to the user so far, on all devices
+func (s *AuthService) HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	token := s.extractToken(r)
+	if token == "" {
+		s.unauthorized(w, nil)
+		return
+	}
+
+	p, err := s.Authenticate(token)
+	if err != nil {
+		s.unauthorized(w, err)
+		return
+	}
+	if p.Downscoped {
+		writeDownscoped(w)
+		return
+	}
+
+	if err := s.LogoutAll(p.Login); err != nil {
+		log.Printf("[ERROR] failed to log out %s everywhere, %v", p.Login, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	clearCookies(w)
+	json.NewEncoder(w).Encode(map[string]string{"status": "OK", "login": p.Login})
+}
+
+// clearCookies immediately clears the token cookies
+func clearCookies(w http.ResponseWriter) {
 	http.SetCookie(w, &http.Cookie{
 		Path:    "/",
 		Name:    "token",
 		Value:   "",
 		Expires: time.Now(),
 	})
+	http.SetCookie(w, &http.Cookie{
+		Path:     "/",
+		Name:     "refresh_token",
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+}
+
+// HandleJWKS - http handler for /.well-known/jwks.json endpoint, publishes
+// public keys of the token provider, so other services can verify tokens
+func (s *AuthService) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	ksp, ok := s.Tokens.(KeySetProvider)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(ksp.JWKS())
 }
 
 // Handlers - returns a http.Handler with all the handlers,
 // prefix default is "/auth", the handlers will be available at
-// /auth/signin, /auth/signup, /auth/check, /auth/logout
+// /auth/signin, /auth/signup, /auth/refresh, /auth/check, /auth/logout,
+// /auth/logout/all, /auth/downscope, /auth/authorize, /auth/mfa/verify,
+// /auth/mfa/totp/enroll, /auth/mfa/totp/qr, /auth/mfa/totp/confirm,
+// /auth/mfa/recovery-codes, /auth/webauthn/register/begin and /finish,
+// /auth/webauthn/login/begin and /finish, /auth/magic-link, /auth/magic-link/verify,
+// /auth/verify-email, /auth/verify-email/resend, /auth/password/forgot,
+// /auth/password/reset, /auth/password/change, /auth/unlock
+// and /auth/.well-known/jwks.json
 func (s *AuthService) Handlers(prefix string) http.Handler {
 	if prefix == "" {
 		prefix = "/auth"
@@ -108,25 +833,50 @@ func (s *AuthService) Handlers(prefix string) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc(prefix+"/signin", s.HandleSignin)
 	mux.HandleFunc(prefix+"/signup", s.HandleSignup)
+	mux.HandleFunc(prefix+"/refresh", s.HandleRefresh)
 	mux.HandleFunc(prefix+"/check", s.HandleCheck)
 	mux.HandleFunc(prefix+"/logout", s.Logout)
-	return mux
+	mux.HandleFunc(prefix+"/logout/all", s.HandleLogoutAll)
+	mux.HandleFunc(prefix+"/downscope", s.HandleDownscope)
+	mux.HandleFunc(prefix+"/authorize", s.HandleAuthorize)
+	mux.HandleFunc(prefix+"/mfa/verify", s.HandleMFAVerify)
+	mux.HandleFunc(prefix+"/magic-link", s.HandleMagicLink)
+	mux.HandleFunc(prefix+"/magic-link/verify", s.HandleMagicLinkVerify)
+	mux.HandleFunc(prefix+"/verify-email", s.HandleVerifyEmail)
+	mux.HandleFunc(prefix+"/verify-email/resend", s.HandleVerifyEmailResend)
+	mux.HandleFunc(prefix+"/password/forgot", s.HandlePasswordForgot)
+	mux.HandleFunc(prefix+"/password/reset", s.HandlePasswordReset)
+	mux.Handle(prefix+"/password/change", s.Auth(RequireSession(http.HandlerFunc(s.HandlePasswordChange))))
+	mux.Handle(prefix+"/unlock", s.Auth(RequireRole("admin")(http.HandlerFunc(s.HandleUnlock))))
+	mux.Handle(prefix+"/mfa/totp/enroll", s.Auth(RequireSession(http.HandlerFunc(s.HandleTOTPEnroll))))
+	mux.Handle(prefix+"/mfa/totp/qr", s.Auth(RequireSession(http.HandlerFunc(s.HandleTOTPQRCode))))
+	mux.Handle(prefix+"/mfa/totp/confirm", s.Auth(RequireSession(http.HandlerFunc(s.HandleTOTPConfirm))))
+	mux.Handle(prefix+"/mfa/recovery-codes", s.Auth(RequireSession(http.HandlerFunc(s.HandleRecoveryCodes))))
+	mux.Handle(prefix+"/webauthn/register/begin", s.Auth(RequireSession(http.HandlerFunc(s.HandlePasskeyRegisterBegin))))
+	mux.Handle(prefix+"/webauthn/register/finish", s.Auth(RequireSession(http.HandlerFunc(s.HandlePasskeyRegisterFinish))))
+	mux.HandleFunc(prefix+"/webauthn/login/begin", s.HandlePasskeyLoginBegin)
+	mux.HandleFunc(prefix+"/webauthn/login/finish", s.HandlePasskeyLoginFinish)
+	mux.HandleFunc(prefix+"/.well-known/jwks.json", s.HandleJWKS)
+	return s.rateLimit(prefix, mux)
 }
 
+// Auth - middleware letting through requests with a valid token only,
+// the token is looked up by the chain of extractors. The caller is available
+// to the next handlers with PrincipalFromContext
 func (s *AuthService) Auth(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("token")
-		if err != nil {
-			w.WriteHeader(http.StatusNoContent)
+		token := s.extractToken(r)
+		if token == "" {
+			s.unauthorized(w, nil)
 			return
 		}
 
-		_, err = s.Check(c.Value)
+		p, err := s.Authenticate(token)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			s.unauthorized(w, err)
 			return
 		}
 
-		h.ServeHTTP(w, r)
+		h.ServeHTTP(w, WithPrincipal(WithRequestAttributes(withClientIP(r, s.ClientIP(r))), p))
 	})
 }
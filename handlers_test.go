@@ -147,8 +147,200 @@ func TestServerSignupSignin(t *testing.T) {
 
 	// check response cookie
 	cookies := response.Result().Cookies()
-	assert.Equal(t, 1, len(cookies), "Expected 1 cookie but got %d", len(cookies))
+	assert.Equal(t, 2, len(cookies), "Expected 2 cookies but got %d", len(cookies))
 	assert.Equal(t, "token", cookies[0].Name, "Expected cookie name token but got %s", cookies[0].Name)
 	assert.Equal(t, "", cookies[0].Value, "Expected empty cookie value but got %s", cookies[0].Value)
+	assert.Equal(t, "refresh_token", cookies[1].Name, "Expected cookie name refresh_token but got %s", cookies[1].Name)
+	assert.Equal(t, "", cookies[1].Value, "Expected empty cookie value but got %s", cookies[1].Value)
 
 }
+
+func TestHandleJWKS(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), ECDSAKeyPEM(pemKey(t, "ecdsa")))
+	authService := NewAuthService(tp, NewUsers())
+
+	req, _ := http.NewRequest("GET", "/auth/.well-known/jwks.json", nil)
+	response := httptest.NewRecorder()
+	authService.Handlers("/auth").ServeHTTP(response, req)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+
+	var jwks JWKSet
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &jwks))
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "EC", jwks.Keys[0].Kty)
+	assert.Equal(t, "P-256", jwks.Keys[0].Crv)
+	assert.Equal(t, "ES256", jwks.Keys[0].Alg)
+}
+
+func TestHandleRefresh(t *testing.T) {
+	_, authService := NewServer()
+	_, err := authService.Signup("user1", "password1")
+	assert.NoError(t, err)
+	session, err := authService.NewSession("user1")
+	assert.NoError(t, err)
+
+	// refresh token in a json body
+	reqBodyBytes, _ := json.Marshal(map[string]string{"refresh_token": session.Refresh.Token})
+	req, _ := http.NewRequest("POST", "/auth/refresh", bytes.NewBuffer(reqBodyBytes))
+	response := httptest.NewRecorder()
+	authService.HandleRefresh(response, req)
+
+	var respBody map[string]string
+	json.Unmarshal(response.Body.Bytes(), &respBody)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "user1", respBody["login"])
+	assert.NotEmpty(t, respBody["token"])
+	assert.NotEmpty(t, respBody["refresh_token"])
+	assert.NotEqual(t, session.Refresh.Token, respBody["refresh_token"])
+
+	// refresh token in a cookie
+	req, _ = http.NewRequest("POST", "/auth/refresh", nil)
+	req.Header.Set("Cookie", "refresh_token="+respBody["refresh_token"])
+	response = httptest.NewRecorder()
+	authService.HandleRefresh(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// reused refresh token
+	req, _ = http.NewRequest("POST", "/auth/refresh", bytes.NewBuffer(reqBodyBytes))
+	response = httptest.NewRecorder()
+	authService.HandleRefresh(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// no refresh token
+	req, _ = http.NewRequest("POST", "/auth/refresh", nil)
+	response = httptest.NewRecorder()
+	authService.HandleRefresh(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	authService := NewAuthService(tp, NewUsers())
+	_, err := authService.Signup("user1", "password1")
+	assert.NoError(t, err)
+
+	session, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	// logout revokes both tokens
+	req, _ := http.NewRequest("GET", "/auth/logout", nil)
+	req.Header.Set("Cookie", "token="+session.Access.Token+"; refresh_token="+session.Refresh.Token)
+	response := httptest.NewRecorder()
+	authService.Logout(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	_, err = authService.Check(session.Access.Token)
+	assert.EqualError(t, err, ErrTokenRevoked)
+	_, err = authService.Refresh(session.Refresh.Token)
+	assert.Error(t, err)
+
+	// logout everywhere revokes tokens issued on other devices
+	first, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	second, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	req, _ = http.NewRequest("POST", "/auth/logout/all", nil)
+	req.Header.Set("Cookie", "token="+first.Access.Token)
+	response = httptest.NewRecorder()
+	authService.HandleLogoutAll(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	_, err = authService.Check(second.Access.Token)
+	assert.EqualError(t, err, ErrTokenRevoked)
+	_, err = authService.Refresh(second.Refresh.Token)
+	assert.Error(t, err)
+
+	// already logged out
+	response = httptest.NewRecorder()
+	authService.HandleLogoutAll(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// tokens issued right after logging out everywhere are valid
+	token, err := authService.Signin("user1", "password1")
+	assert.NoError(t, err)
+	login, err := authService.Check(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+}
+
+func TestLogoutAllWithoutRevocations(t *testing.T) {
+	// access tokens can't be revoked, refresh tokens still are
+	_, authService := NewServer()
+	_, err := authService.Signup("user1", "password1")
+	assert.NoError(t, err)
+	first, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	second, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("POST", "/auth/logout/all", nil)
+	req.Header.Set("Cookie", "token="+first.Access.Token)
+	response := httptest.NewRecorder()
+	authService.HandleLogoutAll(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	_, err = authService.Refresh(first.Refresh.Token)
+	assert.Error(t, err)
+	_, err = authService.Check(first.Access.Token)
+	assert.NoError(t, err)
+
+	session, err := authService.ChangePassword("user1", "password1", "password2", true)
+	assert.NoError(t, err)
+	assert.NotNil(t, session.Access)
+	_, err = authService.Refresh(second.Refresh.Token)
+	assert.Error(t, err)
+}
+
+func TestHandleSignupDuplicate(t *testing.T) {
+	_, authService := NewServer()
+	reqBodyBytes, _ := json.Marshal(map[string]string{"login": "user1", "password": "password1"})
+
+	req, _ := http.NewRequest("POST", "/auth/signup", bytes.NewBuffer(reqBodyBytes))
+	response := httptest.NewRecorder()
+	authService.HandleSignup(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// second signup with the same login doesn't take over the account
+	reqBodyBytes, _ = json.Marshal(map[string]string{"login": "user1", "password": "hijacked"})
+	req, _ = http.NewRequest("POST", "/auth/signup", bytes.NewBuffer(reqBodyBytes))
+	response = httptest.NewRecorder()
+	authService.HandleSignup(response, req)
+	assert.Equal(t, http.StatusConflict, response.Code)
+}
+
+func TestHandlersHashPasswords(t *testing.T) {
+	_, authService := NewServer()
+	reqBodyBytes, _ := json.Marshal(map[string]string{"login": "user1", "password": "password1"})
+
+	req, _ := http.NewRequest("POST", "/auth/signup", bytes.NewBuffer(reqBodyBytes))
+	response := httptest.NewRecorder()
+	authService.HandleSignup(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// the password is not stored in plaintext
+	user, err := authService.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "password1", user.Password)
+
+	// users signed up over http can sign in with the Go API and vice versa
+	token, err := authService.Signin("user1", "password1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	_, err = authService.Signup("user2", "password2")
+	assert.NoError(t, err)
+	reqBodyBytes, _ = json.Marshal(map[string]string{"login": "user2", "password": "password2"})
+	req, _ = http.NewRequest("POST", "/auth/signin", bytes.NewBuffer(reqBodyBytes))
+	response = httptest.NewRecorder()
+	authService.HandleSignin(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// wrong password
+	reqBodyBytes, _ = json.Marshal(map[string]string{"login": "user2", "password": "password1"})
+	req, _ = http.NewRequest("POST", "/auth/signin", bytes.NewBuffer(reqBodyBytes))
+	response = httptest.NewRecorder()
+	authService.HandleSignin(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const ErrUnknownHash = "unknown password hash format"
+
+// Limits of parameters accepted from stored hashes, so a malformed or imported
+// hash can't crash verification or make it a CPU or memory hog
+const (
+	maxArgon2Memory = 1 << 20 // KiB
+	maxArgon2Time   = 64
+	maxScryptMemory = 1 << 30 // bytes, 128*r*N
+	maxScryptP      = 16
+	maxPBKDF2Iter   = 10_000_000
+	maxBcryptCost   = 16
+	minHashKeyLen   = 16
+)
+
+type PasswordHasher interface {
+	// Hash() returns an encoded hash of a password with a random salt
+	Hash(password string) (string, error)
+	// Verify() checks a password against an encoded hash
+	Verify(hash, password string) (bool, error)
+	// NeedsRehash() checks if a hash was made with parameters other than the current ones
+	NeedsRehash(hash string) bool
+	// Recognizes() checks if a hash is in the format of the hasher, by its prefix
+	Recognizes(hash string) bool
+}
+
+// Hashers is a registry of password hashers, new passwords are hashed with
+// the primary one, hashes are verified with the one recognizing their prefix.
+// Hashes made by any other hasher than the primary one need a rehash
+type Hashers struct {
+	Primary   PasswordHasher
+	Verifiers []PasswordHasher
+}
+
+// NewHashers - creates a registry with a given primary hasher, verifiers default
+// to all the supported formats with their default parameters
+func NewHashers(primary PasswordHasher, verifiers ...PasswordHasher) *Hashers {
+	if len(verifiers) == 0 {
+		verifiers = []PasswordHasher{
+			NewArgon2Hasher(DefaultArgon2Params),
+			NewBcryptHasher(bcrypt.DefaultCost),
+			NewScryptHasher(DefaultScryptParams),
+			NewPBKDF2Hasher(DefaultPBKDF2Params),
+			legacyArgon2Hasher{},
+		}
+	}
+	return &Hashers{Primary: primary, Verifiers: verifiers}
+}
+
+// Hash() hashes a password with the primary hasher
+func (h *Hashers) Hash(password string) (string, error) {
+	return h.Primary.Hash(password)
+}
+
+// Verify() checks a password with the hasher recognizing the hash
+func (h *Hashers) Verify(hash, password string) (bool, error) {
+	v := h.lookup(hash)
+	if v == nil {
+		return false, errors.New(ErrUnknownHash)
+	}
+	return v.Verify(hash, password)
+}
+
+// NeedsRehash() is true for hashes of other formats than the primary one
+// and for primary hashes with outdated parameters
+func (h *Hashers) NeedsRehash(hash string) bool {
+	if !h.Primary.Recognizes(hash) {
+		return true
+	}
+	return h.Primary.NeedsRehash(hash)
+}
+
+// Recognizes() checks if any of the hashers recognizes a hash
+func (h *Hashers) Recognizes(hash string) bool {
+	return h.lookup(hash) != nil
+}
+
+func (h *Hashers) lookup(hash string) PasswordHasher {
+	if h.Primary.Recognizes(hash) {
+		return h.Primary
+	}
+	for _, v := range h.Verifiers {
+		if v.Recognizes(hash) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Argon2Params are argon2id parameters, every hash keeps the ones it was made with
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params are the parameters hashes were made with before they became configurable
+var DefaultArgon2Params = Argon2Params{Time: 1, Memory: 64 * 1024, Threads: 4, SaltLen: 16, KeyLen: 32}
+
+// Argon2Hasher makes argon2id hashes in the PHC string format
+// `$argon2id$v=19$m=...,t=...,p=...$salt$hash`
+type Argon2Hasher struct {
+	Params Argon2Params
+}
+
+func NewArgon2Hasher(p Argon2Params) *Argon2Hasher {
+	return &Argon2Hasher{Params: p}
+}
+
+func (a *Argon2Hasher) Hash(password string) (string, error) {
+	salt, err := randomBytes(a.Params.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	return a.hash(salt, password), nil
+}
+
+func (a *Argon2Hasher) Verify(hash, password string) (bool, error) {
+	p, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare(key, computed) == 1, nil
+}
+
+func (a *Argon2Hasher) NeedsRehash(hash string) bool {
+	p, _, _, err := decodeArgon2(hash)
+	return err != nil || p != a.Params
+}
+
+func (a *Argon2Hasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (a *Argon2Hasher) hash(salt []byte, password string) string {
+	p := a.Params
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads, b64(salt), b64(key))
+}
+
+func decodeArgon2(hash string) (p Argon2Params, salt, key []byte, err error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errors.New("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	if p.Time < 1 || p.Time > maxArgon2Time || p.Threads < 1 || p.Memory > maxArgon2Memory {
+		return p, nil, nil, fmt.Errorf("argon2id parameters m=%d,t=%d,p=%d out of range", p.Memory, p.Time, p.Threads)
+	}
+	if salt, key, err = decodeSaltKey(parts[4], parts[5]); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
+
+// legacyArgon2Hasher verifies hashes in the format used before PHC strings,
+// raw salt followed by a raw argon2id key made with the default parameters.
+// It's verify-only, such hashes always need a rehash
+type legacyArgon2Hasher struct{}
+
+func (legacyArgon2Hasher) Hash(password string) (string, error) {
+	return "", errors.New("legacy argon2 format is verify-only")
+}
+
+func (legacyArgon2Hasher) Verify(hash, password string) (bool, error) {
+	p := DefaultArgon2Params
+	salt := hash[:p.SaltLen]
+	key := argon2.IDKey([]byte(password), []byte(salt), p.Time, p.Memory, p.Threads, p.KeyLen)
+	return subtle.ConstantTimeCompare([]byte(hash[p.SaltLen:]), key) == 1, nil
+}
+
+func (legacyArgon2Hasher) NeedsRehash(hash string) bool {
+	return true
+}
+
+// Recognizes() checks the length only, the salt is random bytes and may start
+// with `$` as well, so it has to be the last of the verifiers. A plaintext
+// password of the same length can't be told apart from a legacy hash
+func (legacyArgon2Hasher) Recognizes(hash string) bool {
+	return len(hash) == int(DefaultArgon2Params.SaltLen+DefaultArgon2Params.KeyLen)
+}
+
+// BcryptHasher makes and verifies `$2a$`, `$2b$` and `$2y$` bcrypt hashes
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{Cost: cost}
+}
+
+func (b *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(hash), err
+}
+
+func (b *BcryptHasher) Verify(hash, password string) (bool, error) {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, err
+	}
+	if cost > maxBcryptCost {
+		return false, fmt.Errorf("bcrypt cost %d out of range", cost)
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *BcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+func (b *BcryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// ScryptParams are scrypt parameters, N is 2^LogN
+type ScryptParams struct {
+	LogN    uint8
+	R       int
+	P       int
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+var DefaultScryptParams = ScryptParams{LogN: 15, R: 8, P: 1, SaltLen: 16, KeyLen: 32}
+
+// ScryptHasher makes scrypt hashes in the PHC string format `$scrypt$ln=...,r=...,p=...$salt$hash`
+type ScryptHasher struct {
+	Params ScryptParams
+}
+
+func NewScryptHasher(p ScryptParams) *ScryptHasher {
+	return &ScryptHasher{Params: p}
+}
+
+func (s *ScryptHasher) Hash(password string) (string, error) {
+	p := s.Params
+	salt, err := randomBytes(p.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, int(p.KeyLen))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", p.LogN, p.R, p.P, b64(salt), b64(key)), nil
+}
+
+func (s *ScryptHasher) Verify(hash, password string) (bool, error) {
+	p, salt, key, err := decodeScrypt(hash)
+	if err != nil {
+		return false, err
+	}
+	computed, err := scrypt.Key([]byte(password), salt, 1<<p.LogN, p.R, p.P, int(p.KeyLen))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, computed) == 1, nil
+}
+
+func (s *ScryptHasher) NeedsRehash(hash string) bool {
+	p, _, _, err := decodeScrypt(hash)
+	return err != nil || p != s.Params
+}
+
+func (s *ScryptHasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$scrypt$")
+}
+
+func decodeScrypt(hash string) (p ScryptParams, salt, key []byte, err error) {
+	// "", "scrypt", "ln=15,r=8,p=1", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return p, nil, nil, errors.New("not a scrypt hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid scrypt parameters: %w", err)
+	}
+	if p.LogN < 1 || p.LogN > 30 || p.R < 1 || p.R > maxScryptMemory/128 || p.P < 1 || p.P > maxScryptP || 128*uint64(p.R)<<p.LogN > maxScryptMemory {
+		return p, nil, nil, fmt.Errorf("scrypt parameters ln=%d,r=%d,p=%d out of range", p.LogN, p.R, p.P)
+	}
+	if salt, key, err = decodeSaltKey(parts[3], parts[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid scrypt hash: %w", err)
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
+
+type PBKDF2Params struct {
+	Iterations int
+	SaltLen    uint32
+	KeyLen     uint32
+}
+
+// DefaultPBKDF2Params follow the OWASP recommendation for PBKDF2-HMAC-SHA256
+var DefaultPBKDF2Params = PBKDF2Params{Iterations: 600000, SaltLen: 16, KeyLen: 32}
+
+// PBKDF2Hasher makes PBKDF2-HMAC-SHA256 hashes in the PHC string format
+// `$pbkdf2-sha256$i=...,l=...$salt$hash`, for deployments restricted to FIPS approved algorithms
+type PBKDF2Hasher struct {
+	Params PBKDF2Params
+}
+
+func NewPBKDF2Hasher(p PBKDF2Params) *PBKDF2Hasher {
+	return &PBKDF2Hasher{Params: p}
+}
+
+func (h *PBKDF2Hasher) Hash(password string) (string, error) {
+	p := h.Params
+	salt, err := randomBytes(p.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, p.Iterations, int(p.KeyLen), sha256.New)
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d,l=%d$%s$%s", p.Iterations, p.KeyLen, b64(salt), b64(key)), nil
+}
+
+func (h *PBKDF2Hasher) Verify(hash, password string) (bool, error) {
+	p, salt, key, err := decodePBKDF2(hash)
+	if err != nil {
+		return false, err
+	}
+	computed := pbkdf2.Key([]byte(password), salt, p.Iterations, int(p.KeyLen), sha256.New)
+	return subtle.ConstantTimeCompare(key, computed) == 1, nil
+}
+
+func (h *PBKDF2Hasher) NeedsRehash(hash string) bool {
+	p, _, _, err := decodePBKDF2(hash)
+	return err != nil || p != h.Params
+}
+
+func (h *PBKDF2Hasher) Recognizes(hash string) bool {
+	return strings.HasPrefix(hash, "$pbkdf2-sha256$")
+}
+
+func decodePBKDF2(hash string) (p PBKDF2Params, salt, key []byte, err error) {
+	// "", "pbkdf2-sha256", "i=600000,l=32", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "pbkdf2-sha256" {
+		return p, nil, nil, errors.New("not a pbkdf2-sha256 hash")
+	}
+	var keyLen uint32
+	if _, err := fmt.Sscanf(parts[2], "i=%d,l=%d", &p.Iterations, &keyLen); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid pbkdf2 parameters: %w", err)
+	}
+	if p.Iterations <= 0 || p.Iterations > maxPBKDF2Iter {
+		return p, nil, nil, fmt.Errorf("pbkdf2 iterations %d out of range", p.Iterations)
+	}
+	if salt, key, err = decodeSaltKey(parts[3], parts[4]); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid pbkdf2 hash: %w", err)
+	}
+	if uint32(len(key)) != keyLen {
+		return p, nil, nil, fmt.Errorf("pbkdf2 key length %d doesn't match l=%d", len(key), keyLen)
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), keyLen
+	return p, salt, key, nil
+}
+
+func decodeSaltKey(salt, key string) ([]byte, []byte, error) {
+	s, err := base64.RawStdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("salt: %w", err)
+	}
+	k, err := base64.RawStdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("key: %w", err)
+	}
+	// an empty key would match any password
+	if len(k) < minHashKeyLen {
+		return nil, nil, fmt.Errorf("key of %d bytes is too short", len(k))
+	}
+	return s, k, nil
+}
+
+func randomBytes(n uint32) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+func b64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashers(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+		other  PasswordHasher // same algorithm, other parameters
+	}{
+		{"argon2id", NewArgon2Hasher(Argon2Params{Time: 2, Memory: 8 * 1024, Threads: 1, SaltLen: 8, KeyLen: 16}),
+			"$argon2id$v=19$m=8192,t=2,p=1$", NewArgon2Hasher(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 8, KeyLen: 16})},
+		{"bcrypt", NewBcryptHasher(4), "$2a$04$", NewBcryptHasher(5)},
+		{"scrypt", NewScryptHasher(ScryptParams{LogN: 10, R: 8, P: 1, SaltLen: 16, KeyLen: 32}),
+			"$scrypt$ln=10,r=8,p=1$", NewScryptHasher(ScryptParams{LogN: 11, R: 8, P: 1, SaltLen: 16, KeyLen: 32})},
+		{"pbkdf2", NewPBKDF2Hasher(PBKDF2Params{Iterations: 1000, SaltLen: 16, KeyLen: 32}),
+			"$pbkdf2-sha256$i=1000,l=32$", NewPBKDF2Hasher(PBKDF2Params{Iterations: 2000, SaltLen: 16, KeyLen: 32})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash("password")
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(hash, tt.prefix), hash)
+			assert.True(t, tt.hasher.Recognizes(hash))
+
+			// salt is random
+			other, err := tt.hasher.Hash("password")
+			assert.NoError(t, err)
+			assert.NotEqual(t, hash, other)
+
+			ok, err := tt.hasher.Verify(hash, "password")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = tt.hasher.Verify(hash, "wrong password")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			assert.False(t, tt.hasher.NeedsRehash(hash))
+			assert.True(t, tt.other.NeedsRehash(hash))
+
+			// registry picks the verifier by prefix and asks to rehash to the primary one
+			registry := NewHashers(NewPBKDF2Hasher(PBKDF2Params{Iterations: 1000, SaltLen: 16, KeyLen: 32}), tt.hasher)
+			ok, err = registry.Verify(hash, "password")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.name != "pbkdf2", registry.NeedsRehash(hash))
+		})
+	}
+}
+
+func TestHashersUnknownAndInvalid(t *testing.T) {
+	registry := NewHashers(NewArgon2Hasher(DefaultArgon2Params))
+
+	assert.False(t, registry.Recognizes("password"))
+	ok, err := registry.Verify("password", "password")
+	assert.EqualError(t, err, ErrUnknownHash)
+	assert.False(t, ok)
+
+	for _, invalid := range []string{"$argon2id$", "$argon2id$v=16$m=8192,t=2,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x$c2FsdA$a2V5", "$argon2id$v=19$m=8192,t=2,p=1$!$a2V5",
+		"$scrypt$ln=40,r=8,p=1$c2FsdA$a2V5", "$scrypt$x$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=0,l=3$c2FsdA$a2V5", "$pbkdf2-sha256$i=10,l=32$c2FsdA$a2V5",
+		"$2a$04$short"} {
+		ok, err := registry.Verify(invalid, "password")
+		assert.Error(t, err, invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestHashersMalformedParams(t *testing.T) {
+	registry := NewHashers(NewArgon2Hasher(DefaultArgon2Params))
+	const saltKey = "$c2FsdHNhbHQ$AAAAAAAAAAAAAAAAAAAAAA"
+
+	tbl := []struct {
+		name string
+		hash string
+	}{
+		{"argon2id t=0", "$argon2id$v=19$m=65536,t=0,p=1" + saltKey},
+		{"argon2id p=0", "$argon2id$v=19$m=65536,t=1,p=0" + saltKey},
+		{"argon2id huge t", "$argon2id$v=19$m=65536,t=1000000,p=1" + saltKey},
+		{"argon2id huge m", "$argon2id$v=19$m=4294967295,t=1,p=1" + saltKey},
+		{"argon2id empty key", "$argon2id$v=19$m=8192,t=1,p=1$c2FsdHNhbHQ$"},
+		{"scrypt ln=0", "$scrypt$ln=0,r=8,p=1" + saltKey},
+		{"scrypt huge N", "$scrypt$ln=24,r=8,p=1" + saltKey},
+		{"scrypt r=0", "$scrypt$ln=10,r=0,p=1" + saltKey},
+		{"scrypt huge r", "$scrypt$ln=10,r=9223372036854775807,p=1" + saltKey},
+		{"scrypt huge p", "$scrypt$ln=10,r=8,p=1000" + saltKey},
+		{"pbkdf2 huge i", "$pbkdf2-sha256$i=2000000000,l=16" + saltKey},
+		{"pbkdf2 empty key", "$pbkdf2-sha256$i=1000,l=0$c2FsdHNhbHQ$"},
+		{"bcrypt huge cost", "$2a$31$" + strings.Repeat("a", 53)},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := registry.Verify(tt.hash, "password")
+			assert.Error(t, err)
+			assert.False(t, ok)
+			assert.True(t, registry.NeedsRehash(tt.hash))
+		})
+	}
+}
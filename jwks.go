@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is a set of public keys, served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySetProvider is implemented by token providers able to publish
+// their verification keys
+type KeySetProvider interface {
+	// JWKS() returns public keys tokens can be verified with
+	JWKS() JWKSet
+}
+
+// NewJWK - converts an RSA, ECDSA or Ed25519 public key to a JWK
+func NewJWK(pub crypto.PublicKey, alg string) (JWK, error) {
+	enc := base64.RawURLEncoding
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: alg,
+			N:   enc.EncodeToString(k.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the curve size, see RFC 7518 6.2.1.2
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Use: "sig",
+			Alg: alg,
+			Crv: k.Curve.Params().Name,
+			X:   enc.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			Y:   enc.EncodeToString(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Use: "sig",
+			Alg: alg,
+			Crv: "Ed25519",
+			X:   enc.EncodeToString(k),
+		}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// Thumbprint - returns the RFC 7638 thumbprint of the key, used as a default kid
+func (j JWK) Thumbprint() string {
+	// members are in lexicographic order, as required by the RFC
+	var s string
+	switch j.Kty {
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":%q,"n":%q}`, j.E, j.Kty, j.N)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, j.Crv, j.Kty, j.X, j.Y)
+	default:
+		s = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, j.Crv, j.Kty, j.X)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
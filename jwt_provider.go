@@ -1,24 +1,46 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const ErrRevocationNotConfigured = "token revocation is not configured"
+
 type Claims struct {
-	Login string `json:"login"`
+	Login string   `json:"login"`
+	Roles []string `json:"roles,omitempty"`
+	// Scope is a space-separated list of scopes, as in OAuth 2.0 access tokens
+	Scope string `json:"scope,omitempty"`
+	// Purpose restricts the token to a single use case
+	Purpose string `json:"purpose,omitempty"`
+	// Downscoped marks tokens minted by Downscope
+	Downscoped bool `json:"downscoped,omitempty"`
+	// Generation is the revocation generation of the login the token was issued in
+	Generation int `json:"gen,omitempty"`
 	jwt.RegisteredClaims
 }
 
 type JwtProvider struct {
 	ExpirationTime time.Duration
-	Key            []byte
+	// Keys holds the active signing key and verify-only keys
+	Keys *Keyring
+	// Revocations is an optional store of revoked tokens
+	Revocations RevocationStore
+
+	// err keeps a configuration error (e.g. a malformed PEM) until the first use
+	err error
 }
 
 func NewJwtProvider(opts ...JWTProviderOption) TokenProvider {
-	tp := JwtProvider{}
+	tp := JwtProvider{Keys: NewKeyring()}
 	for _, opt := range opts {
 		opt(&tp)
 	}
@@ -26,36 +48,93 @@ func NewJwtProvider(opts ...JWTProviderOption) TokenProvider {
 }
 
 // New() creates a new token for a given username
-func (t *JwtProvider) New(login string) (*Token, error) {
-	expirationTime := time.Now().Add(t.ExpirationTime)
+func (t *JwtProvider) New(login string, opts ...TokenOption) (*Token, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	key, err := t.Keys.Active()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &Token{}
+	for _, opt := range opts {
+		opt(tmpl)
+	}
+
+	generation := 0
+	if t.Revocations != nil {
+		if generation, err = t.Revocations.Generation(login); err != nil {
+			return nil, err
+		}
+	}
+
+	issuedAt := time.Now()
+	expirationTime := issuedAt.Add(t.ExpirationTime)
+	if !tmpl.ExpiresAt.IsZero() && tmpl.ExpiresAt.Before(expirationTime) {
+		expirationTime = tmpl.ExpiresAt
+	}
 	claims := &Claims{
-		Login: login,
+		Login:      login,
+		Roles:      tmpl.Roles,
+		Scope:      strings.Join(tmpl.Scopes, " "),
+		Purpose:    tmpl.Purpose,
+		Downscoped: tmpl.Downscoped,
+		Generation: generation,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       id,
+			IssuedAt: jwt.NewNumericDate(issuedAt),
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
-	tokenString, err := token.SignedString(t.Key)
+	tokenString, err := token.SignedString(key.signKey())
 	if err != nil {
 		return nil, err
 	}
 
 	return &Token{
-		Token:     tokenString,
-		ExpiresAt: expirationTime,
-		Login:     login,
+		ID:         id,
+		Token:      tokenString,
+		IssuedAt:   issuedAt,
+		ExpiresAt:  expirationTime,
+		Login:      login,
+		Roles:      tmpl.Roles,
+		Scopes:     tmpl.Scopes,
+		Purpose:    tmpl.Purpose,
+		Downscoped: tmpl.Downscoped,
 	}, nil
 }
 
-// Validate() validates a given token
+// Validate() validates a given token, the verification key is chosen by the `kid` header
 func (t *JwtProvider) Validate(token string) (*Token, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
 	claims := &Claims{}
 
 	tkn, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return t.Key, nil
+		key, err := t.lookupKey(token)
+		if err != nil {
+			return nil, err
+		}
+		// the key defines the method, so an RS256 public key
+		// can't be used as an HS256 secret
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key.verifyKey(), nil
 	})
 	if err != nil {
 		return nil, err
@@ -64,20 +143,112 @@ func (t *JwtProvider) Validate(token string) (*Token, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	return &Token{
-		Token:     token,
-		ExpiresAt: claims.ExpiresAt.Time,
-		Login:     claims.Login,
-	}, nil
+	validated := &Token{
+		ID:         claims.ID,
+		Token:      token,
+		ExpiresAt:  claims.ExpiresAt.Time,
+		Login:      claims.Login,
+		Roles:      claims.Roles,
+		Scopes:     strings.Fields(claims.Scope),
+		Purpose:    claims.Purpose,
+		Downscoped: claims.Downscoped,
+	}
+	if claims.IssuedAt != nil {
+		validated.IssuedAt = claims.IssuedAt.Time
+	}
+
+	if t.Revocations != nil {
+		revoked, err := t.Revocations.IsRevoked(validated.ID, validated.Login, claims.Generation)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, errors.New(ErrTokenRevoked)
+		}
+	}
+
+	return validated, nil
 }
 
 // Refresh() refreshes a given token - validate it and create a new one if it's valid
 func (t *JwtProvider) Refresh(token string) (*Token, error) {
 	validated, err := t.Validate(token)
-	if err == nil {
-		return t.New(validated.Login)
+	if err != nil {
+		return nil, err
+	}
+	// single purpose tokens are short-lived by design
+	if validated.Purpose != "" {
+		return nil, errors.New(ErrTokenPurpose)
+	}
+	// downscoped tokens can't outlive the token they were minted from
+	if validated.Downscoped {
+		return nil, errors.New(ErrTokenDownscoped)
+	}
+	return t.New(validated.Login, WithRoles(validated.Roles...), WithScopes(validated.Scopes...))
+}
+
+// Revoke() revokes a given token until it expires
+func (t *JwtProvider) Revoke(token string) error {
+	if t.Revocations == nil {
+		return errors.New(ErrRevocationNotConfigured)
+	}
+	validated, err := t.Validate(token)
+	if err != nil {
+		return err
+	}
+	return t.Revocations.Revoke(validated.ID, validated.ExpiresAt)
+}
+
+// RevokeAll() revokes all tokens of a login issued so far
+func (t *JwtProvider) RevokeAll(login string) error {
+	if t.Revocations == nil {
+		return errors.New(ErrRevocationNotConfigured)
 	}
-	return nil, err
+	return t.Revocations.RevokeLogin(login)
+}
+
+// CanRevoke() reports if a revocation store is configured,
+// Revoke() and RevokeAll() fail without one
+func (t *JwtProvider) CanRevoke() bool {
+	return t.Revocations != nil
+}
+
+// Rotate() makes a new key active, the previous one keeps verifying tokens
+// for ExpirationTime, so tokens it signed can't outlive it
+func (t *JwtProvider) Rotate(key *SigningKey) {
+	t.Keys.Rotate(key, t.ExpirationTime)
+}
+
+// JWKS() returns the public keys tokens can be verified with,
+// HMAC keys are never published
+func (t *JwtProvider) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	if t.err != nil {
+		return set
+	}
+
+	for _, key := range t.Keys.Keys() {
+		if key.PrivateKey == nil {
+			continue
+		}
+		jwk, err := NewJWK(key.PrivateKey.Public(), key.Method.Alg())
+		if err != nil {
+			continue
+		}
+		jwk.Kid = key.ID
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// lookupKey returns the key a token has to be verified with,
+// tokens without `kid` header are verified with the active key
+func (t *JwtProvider) lookupKey(token *jwt.Token) (*SigningKey, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return t.Keys.Active()
+	}
+	return t.Keys.Get(kid)
 }
 
 // JWTProviderOption is a function that configures a JwtProvider.
@@ -90,9 +261,84 @@ func ExpirationTime(exp time.Duration) JWTProviderOption {
 	}
 }
 
-// Key sets the key for a token
+// Key sets the HMAC key tokens are signed with
 func Key(key string) JWTProviderOption {
 	return func(j *JwtProvider) {
-		j.Key = []byte(key)
+		j.Keys.SetActive(NewHMACKey("", []byte(key)))
+	}
+}
+
+// RSAKeyPEM sets a PEM encoded RSA private key, tokens are signed with RS256
+func RSAKeyPEM(pem []byte) JWTProviderOption {
+	return func(j *JwtProvider) {
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			j.err = fmt.Errorf("rsa key: %w", err)
+			return
+		}
+		j.setActive(NewAsymmetricKey("", key))
+	}
+}
+
+// ECDSAKeyPEM sets a PEM encoded ECDSA private key, tokens are signed
+// with ES256, ES384 or ES512 depending on the key curve
+func ECDSAKeyPEM(pem []byte) JWTProviderOption {
+	return func(j *JwtProvider) {
+		key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+		if err != nil {
+			j.err = fmt.Errorf("ecdsa key: %w", err)
+			return
+		}
+		j.setActive(NewAsymmetricKey("", key))
+	}
+}
+
+// Ed25519KeyPEM sets a PEM encoded Ed25519 private key, tokens are signed with EdDSA
+func Ed25519KeyPEM(pem []byte) JWTProviderOption {
+	return func(j *JwtProvider) {
+		key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+		if err != nil {
+			j.err = fmt.Errorf("ed25519 key: %w", err)
+			return
+		}
+		j.setActive(NewAsymmetricKey("", key.(crypto.Signer)))
+	}
+}
+
+// Revocations sets the store of revoked tokens, revoked tokens fail validation
+func Revocations(store RevocationStore) JWTProviderOption {
+	return func(j *JwtProvider) {
+		j.Revocations = store
+	}
+}
+
+// SigningKeys sets the active signing key and verify-only keys,
+// e.g. the ones being rotated out
+func SigningKeys(active *SigningKey, verifyOnly ...*SigningKey) JWTProviderOption {
+	return func(j *JwtProvider) {
+		for _, key := range verifyOnly {
+			j.Keys.Add(key)
+		}
+		j.Keys.SetActive(active)
+	}
+}
+
+func (t *JwtProvider) setActive(key *SigningKey, err error) {
+	if err != nil {
+		t.err = err
+		return
+	}
+	t.Keys.SetActive(key)
+}
+
+func ecdsaMethod(key *ecdsa.PrivateKey) (jwt.SigningMethod, error) {
+	switch key.Curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
 	}
+	return nil, fmt.Errorf("ecdsa key: unsupported curve %s", key.Curve.Params().Name)
 }
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -71,3 +79,190 @@ func Test_Refresh(t *testing.T) {
 	assert.Error(t, err)
 	assert.Empty(t, ir)
 }
+
+// pemKey generates a PKCS#8 PEM encoded private key for tests
+func pemKey(t *testing.T, kind string) []byte {
+	var key interface{}
+	var err error
+	switch kind {
+	case "rsa":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	assert.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func Test_AsymmetricKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  func([]byte) JWTProviderOption
+		alg  string
+		kty  string
+	}{
+		{"rsa", RSAKeyPEM, "RS256", "RSA"},
+		{"ecdsa", ECDSAKeyPEM, "ES256", "EC"},
+		{"ed25519", Ed25519KeyPEM, "EdDSA", "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := NewJwtProvider(ExpirationTime(time.Minute), tt.opt(pemKey(t, tt.name)))
+			token, err := tp.New("username")
+			assert.NoError(t, err)
+			assert.NotEmpty(t, token.Token)
+
+			claims, err := tp.Validate(token.Token)
+			assert.NoError(t, err)
+			assert.Equal(t, "username", claims.Login)
+
+			jwks := tp.(KeySetProvider).JWKS()
+			assert.Len(t, jwks.Keys, 1)
+			assert.Equal(t, tt.alg, jwks.Keys[0].Alg)
+			assert.Equal(t, tt.kty, jwks.Keys[0].Kty)
+
+			// token signed by a different key of the same type is rejected
+			other := NewJwtProvider(ExpirationTime(time.Minute), tt.opt(pemKey(t, tt.name)))
+			otherToken, err := other.New("username")
+			assert.NoError(t, err)
+			claims, err = tp.Validate(otherToken.Token)
+			assert.Error(t, err)
+			assert.Empty(t, claims)
+
+			// and so is a token signed by an HMAC key
+			other = NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+			otherToken, err = other.New("username")
+			assert.NoError(t, err)
+			claims, err = tp.Validate(otherToken.Token)
+			assert.Error(t, err)
+			assert.Empty(t, claims)
+		})
+	}
+
+	// malformed PEM is reported on use
+	tp := NewJwtProvider(ExpirationTime(time.Minute), RSAKeyPEM([]byte("not a key")))
+	token, err := tp.New("username")
+	assert.Error(t, err)
+	assert.Empty(t, token)
+
+	// HMAC provider publishes no keys
+	tp = NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	assert.Empty(t, tp.(KeySetProvider).JWKS().Keys)
+}
+
+func Test_KeyRotation(t *testing.T) {
+	oldKey := NewHMACKey("old", []byte("old_secret_key"))
+	tp := NewJwtProvider(ExpirationTime(time.Minute), SigningKeys(oldKey)).(*JwtProvider)
+
+	oldToken, err := tp.New("username")
+	assert.NoError(t, err)
+
+	// rotating to an asymmetric key, old tokens are still valid
+	newKey, err := ParsePrivateKeyPEM("new", pemKey(t, "ed25519"))
+	assert.NoError(t, err)
+	tp.Rotate(newKey)
+
+	newToken, err := tp.New("username")
+	assert.NoError(t, err)
+
+	claims, err := tp.Validate(oldToken.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "username", claims.Login)
+
+	claims, err = tp.Validate(newToken.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "username", claims.Login)
+
+	// the old key is retired at the end of the overlap
+	retiring, err := tp.Keys.Get("old")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), retiring.RetireAt, time.Second)
+
+	// only the public key is published, with its kid
+	jwks := tp.JWKS()
+	assert.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "new", jwks.Keys[0].Kid)
+
+	// active key can't be retired
+	assert.Error(t, tp.Keys.Retire("new", time.Now()))
+
+	// retired key doesn't verify tokens anymore
+	assert.NoError(t, tp.Keys.Retire("old", time.Now()))
+	claims, err = tp.Validate(oldToken.Token)
+	assert.Error(t, err)
+	assert.Empty(t, claims)
+
+	// unknown kid
+	other := NewJwtProvider(ExpirationTime(time.Minute), SigningKeys(NewHMACKey("other", []byte("old_secret_key"))))
+	otherToken, err := other.New("username")
+	assert.NoError(t, err)
+	claims, err = tp.Validate(otherToken.Token)
+	assert.Error(t, err)
+	assert.Empty(t, claims)
+}
+
+func Test_VerifyOnlyKeys(t *testing.T) {
+	// tokens signed by the previous deployment key
+	prev := NewJwtProvider(ExpirationTime(time.Minute), SigningKeys(NewHMACKey("v1", []byte("secret_v1"))))
+	token, err := prev.New("username")
+	assert.NoError(t, err)
+
+	// the next deployment signs with v2 and only verifies v1
+	tp := NewJwtProvider(ExpirationTime(time.Minute), SigningKeys(
+		NewHMACKey("v2", []byte("secret_v2")),
+		NewHMACKey("v1", []byte("secret_v1")),
+	))
+	claims, err := tp.Validate(token.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "username", claims.Login)
+
+	// tokens without kid are verified with the active key
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{Login: "username",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}})
+	legacyString, err := legacy.SignedString([]byte("secret_v2"))
+	assert.NoError(t, err)
+	claims, err = tp.Validate(legacyString)
+	assert.NoError(t, err)
+	assert.Equal(t, "username", claims.Login)
+}
+
+func Test_Revoke(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+
+	token, err := tp.New("username")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.ID)
+	other, err := tp.New("username")
+	assert.NoError(t, err)
+	assert.NotEqual(t, token.ID, other.ID)
+
+	claims, err := tp.Validate(token.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, token.ID, claims.ID)
+
+	assert.NoError(t, tp.(Revoker).Revoke(token.Token))
+	claims, err = tp.Validate(token.Token)
+	assert.EqualError(t, err, ErrTokenRevoked)
+	assert.Empty(t, claims)
+
+	// revoked token can't be refreshed either
+	refreshed, err := tp.Refresh(token.Token)
+	assert.Error(t, err)
+	assert.Empty(t, refreshed)
+
+	// other tokens are not affected
+	_, err = tp.Validate(other.Token)
+	assert.NoError(t, err)
+
+	// provider without a store can't revoke
+	tp = NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	token, err = tp.New("username")
+	assert.NoError(t, err)
+	assert.Error(t, tp.(Revoker).Revoke(token.Token))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	ErrKeyNotFound = "signing key not found"
+	ErrKeyRetired  = "signing key retired"
+	ErrNoActiveKey = "no active signing key"
+)
+
+// SigningKey is a key of a Keyring, tokens carry its ID in the `kid` header
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Secret is a shared HMAC secret, PrivateKey is used by asymmetric methods
+	Secret     []byte
+	PrivateKey crypto.Signer
+	// RetireAt is the time the key stops verifying tokens, zero means never
+	RetireAt time.Time
+}
+
+// NewHMACKey - creates an HS256 key, kid is derived from the secret if empty
+func NewHMACKey(kid string, secret []byte) *SigningKey {
+	if kid == "" {
+		sum := sha256.Sum256(secret)
+		kid = base64.RawURLEncoding.EncodeToString(sum[:8])
+	}
+	return &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, Secret: secret}
+}
+
+// NewAsymmetricKey - creates a key from an RSA, ECDSA or Ed25519 private key,
+// kid defaults to the RFC 7638 thumbprint of the public key
+func NewAsymmetricKey(kid string, key crypto.Signer) (*SigningKey, error) {
+	var method jwt.SigningMethod
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		m, err := ecdsaMethod(k)
+		if err != nil {
+			return nil, err
+		}
+		method = m
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	if kid == "" {
+		jwk, err := NewJWK(key.Public(), method.Alg())
+		if err != nil {
+			return nil, err
+		}
+		kid = jwk.Thumbprint()
+	}
+	return &SigningKey{ID: kid, Method: method, PrivateKey: key}, nil
+}
+
+// ParsePrivateKeyPEM - parses a PEM encoded PKCS#8, PKCS#1 or SEC 1 private key
+// and creates a SigningKey with it
+func ParsePrivateKeyPEM(kid string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM data")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return NewAsymmetricKey(kid, signer)
+}
+
+// signKey returns the key material tokens are signed with
+func (k *SigningKey) signKey() interface{} {
+	if k.PrivateKey != nil {
+		return k.PrivateKey
+	}
+	return k.Secret
+}
+
+// verifyKey returns the key material tokens are verified with
+func (k *SigningKey) verifyKey() interface{} {
+	if k.PrivateKey != nil {
+		return k.PrivateKey.Public()
+	}
+	return k.Secret
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// Keyring holds one active signing key and any number of verify-only keys,
+// so signing keys can be rotated without invalidating issued tokens
+type Keyring struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*SigningKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*SigningKey)}
+}
+
+// Add - adds a verify-only key, replacing a key with the same ID
+func (k *Keyring) Add(key *SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.ID] = key
+}
+
+// SetActive - adds a key and makes it the one new tokens are signed with
+func (k *Keyring) SetActive(key *SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key.RetireAt = time.Time{}
+	k.keys[key.ID] = key
+	k.active = key.ID
+}
+
+// Rotate - makes a new key active, the previous active key keeps verifying
+// tokens for the `overlap` duration and retires afterwards
+func (k *Keyring) Rotate(key *SigningKey, overlap time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if prev, ok := k.keys[k.active]; ok && prev.ID != key.ID {
+		prev.RetireAt = time.Now().Add(overlap)
+	}
+	key.RetireAt = time.Time{}
+	k.keys[key.ID] = key
+	k.active = key.ID
+}
+
+// Retire - schedules retirement of a verify-only key at a given time
+func (k *Keyring) Retire(kid string, at time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return fmt.Errorf("%s: %s", ErrKeyNotFound, kid)
+	}
+	if kid == k.active {
+		return fmt.Errorf("can't retire active key %s, rotate it first", kid)
+	}
+	key.RetireAt = at
+	return nil
+}
+
+// Active - returns the key new tokens are signed with
+func (k *Keyring) Active() (*SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.active]
+	if !ok {
+		return nil, errors.New(ErrNoActiveKey)
+	}
+	return key, nil
+}
+
+// Get - returns a key by ID, retired keys are not returned
+func (k *Keyring) Get(kid string) (*SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", ErrKeyNotFound, kid)
+	}
+	if key.retired(time.Now()) {
+		return nil, fmt.Errorf("%s: %s", ErrKeyRetired, kid)
+	}
+	return key, nil
+}
+
+// Keys - returns keys which are not retired yet, sorted by ID,
+// retired keys are dropped from the keyring
+func (k *Keyring) Keys() []*SigningKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	res := make([]*SigningKey, 0, len(k.keys))
+	for kid, key := range k.keys {
+		if key.retired(now) {
+			delete(k.keys, kid)
+			continue
+		}
+		res = append(res, key)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const ErrLocked = "too many failed signin attempts"
+
+// LockoutState is the failed attempt count of a login or an IP
+type LockoutState struct {
+	Failures int
+	// LockedUntil is the time the next attempt is accepted at
+	LockedUntil time.Time
+	// ExpiresAt is the time the state can be forgotten at
+	ExpiresAt time.Time
+}
+
+type LockoutStore interface {
+	// Get() returns the state of a key, a missing key has a zero state
+	Get(key string) (LockoutState, error)
+	// Update() changes the state of a key atomically and returns the new state
+	Update(key string, change func(*LockoutState)) (LockoutState, error)
+	// Delete() forgets the state of a key
+	Delete(key string) error
+}
+
+// MemoryLockoutStore keeps lockout states in memory, expired states are dropped
+type MemoryLockoutStore struct {
+	mu     sync.Mutex
+	states map[string]LockoutState
+}
+
+func NewMemoryLockoutStore() *MemoryLockoutStore {
+	return &MemoryLockoutStore{states: make(map[string]LockoutState)}
+}
+
+// Get() returns the state of a key
+func (m *MemoryLockoutStore) Get(key string) (LockoutState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.states[key]
+	if !ok || time.Now().After(st.ExpiresAt) {
+		return LockoutState{}, nil
+	}
+	return st, nil
+}
+
+// Update() changes the state of a key atomically
+func (m *MemoryLockoutStore) Update(key string, change func(*LockoutState)) (LockoutState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for k, st := range m.states {
+		if now.After(st.ExpiresAt) {
+			delete(m.states, k)
+		}
+	}
+	st := m.states[key]
+	change(&st)
+	m.states[key] = st
+	return st, nil
+}
+
+// Delete() forgets the state of a key
+func (m *MemoryLockoutStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, key)
+	return nil
+}
+
+// LockedError is returned on signin attempts of a locked login or IP
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrLocked, e.Until.Format(time.RFC3339))
+}
+
+// RetryAfter() returns whole seconds until the next attempt is accepted, at least one
+func (e *LockedError) RetryAfter() int {
+	return max(1, int(math.Ceil(time.Until(e.Until).Seconds())))
+}
+
+// Lockout slows down password guessing. Failed attempts of a login are delayed
+// exponentially after a few free ones and the login is locked for a while after
+// too many of them. Failures of an IP are counted across logins, with a higher limit
+type Lockout struct {
+	Store LockoutStore
+	// FreeFailures is the number of failures of a login before delays start
+	FreeFailures int
+	// BaseDelay is the first delay, each next failure doubles it up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxFailures is the number of failures of a login to lock it for LockoutDuration
+	MaxFailures     int
+	LockoutDuration time.Duration
+	// IPMaxFailures is the number of failures of an IP to lock it for LockoutDuration
+	IPMaxFailures int
+	// ResetAfter is the time failures are remembered for since the last one
+	ResetAfter time.Duration
+	// Now returns the current time
+	Now func() time.Time
+}
+
+// NewLockout - returns a lockout with default limits keeping state in a given store
+func NewLockout(store LockoutStore) *Lockout {
+	return &Lockout{
+		Store:           store,
+		FreeFailures:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		MaxFailures:     10,
+		LockoutDuration: 15 * time.Minute,
+		IPMaxFailures:   100,
+		ResetAfter:      time.Hour,
+		Now:             time.Now,
+	}
+}
+
+func lockoutLoginKey(login string) string { return "login:" + login }
+func lockoutIPKey(ip string) string       { return "ip:" + ip }
+
+// Check() returns *LockedError if a login or an IP, which may be empty, is locked
+func (l *Lockout) Check(login, ip string) error {
+	keys := []string{lockoutLoginKey(login)}
+	if ip != "" {
+		keys = append(keys, lockoutIPKey(ip))
+	}
+	now := l.Now()
+	for _, key := range keys {
+		st, err := l.Store.Get(key)
+		if err != nil {
+			return err
+		}
+		if now.Before(st.LockedUntil) {
+			return &LockedError{Until: st.LockedUntil}
+		}
+	}
+	return nil
+}
+
+// Fail() records a failed attempt of a login from an IP, which may be empty
+func (l *Lockout) Fail(login, ip string) error {
+	now := l.Now()
+	_, err := l.Store.Update(lockoutLoginKey(login), func(st *LockoutState) {
+		st.Failures++
+		var delay time.Duration
+		switch {
+		case st.Failures >= l.MaxFailures:
+			delay = l.LockoutDuration
+		case st.Failures > l.FreeFailures:
+			delay = l.BaseDelay << min(st.Failures-l.FreeFailures-1, 30)
+			if delay > l.MaxDelay || delay <= 0 {
+				delay = l.MaxDelay
+			}
+		}
+		st.LockedUntil = now.Add(delay)
+		st.ExpiresAt = st.LockedUntil.Add(l.ResetAfter)
+	})
+	if err != nil || ip == "" {
+		return err
+	}
+
+	_, err = l.Store.Update(lockoutIPKey(ip), func(st *LockoutState) {
+		st.Failures++
+		if st.Failures >= l.IPMaxFailures {
+			st.LockedUntil = now.Add(l.LockoutDuration)
+		}
+		st.ExpiresAt = now.Add(max(l.LockoutDuration, l.ResetAfter))
+	})
+	return err
+}
+
+// Unlock() forgets failures of a login, e.g. on a successful signin
+func (l *Lockout) Unlock(login string) error {
+	return l.Store.Delete(lockoutLoginKey(login))
+}
+
+// UnlockIP() forgets failures of an IP
+func (l *Lockout) UnlockIP(ip string) error {
+	return l.Store.Delete(lockoutIPKey(ip))
+}
+
+// UnlockSignin - forgets failed signin attempts of a login and an IP,
+// either may be empty
+func (s *AuthService) UnlockSignin(login, ip string) error {
+	if s.Lockout == nil {
+		return nil
+	}
+	if login != "" {
+		if err := s.Lockout.Unlock(login); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return s.Lockout.UnlockIP(ip)
+	}
+	return nil
+}
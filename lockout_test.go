@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := NewLockout(NewMemoryLockoutStore())
+	l.Now = func() time.Time { return now }
+	l.IPMaxFailures = 12
+
+	lockedFor := func(login, ip string) time.Duration {
+		var locked *LockedError
+		if err := l.Check(login, ip); errors.As(err, &locked) {
+			return locked.Until.Sub(now)
+		}
+		return 0
+	}
+
+	// a few failures are free, then delays double
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.Fail("user1", "10.0.0.1"))
+		assert.Zero(t, lockedFor("user1", ""))
+	}
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		assert.NoError(t, l.Fail("user1", "10.0.0.1"))
+		assert.Equal(t, delay, lockedFor("user1", ""))
+		assert.Equal(t, delay, lockedFor("user1", "10.0.0.2"))
+		assert.Zero(t, lockedFor("user2", "10.0.0.1"))
+		now = now.Add(delay)
+	}
+
+	// delays are capped, the login is locked after too many failures
+	l.MaxDelay = 5 * time.Second
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, l.Fail("user1", "10.0.0.1"))
+		assert.Equal(t, 5*time.Second, lockedFor("user1", ""))
+		now = now.Add(5 * time.Second)
+	}
+	assert.NoError(t, l.Fail("user1", "10.0.0.1"))
+	assert.Equal(t, 15*time.Minute, lockedFor("user1", ""))
+
+	// failures of an IP are counted across logins
+	assert.NoError(t, l.Fail("user2", "10.0.0.1"))
+	assert.Zero(t, lockedFor("user3", "10.0.0.1"))
+	assert.NoError(t, l.Fail("user3", "10.0.0.1"))
+	assert.Equal(t, 15*time.Minute, lockedFor("user3", "10.0.0.1"))
+	assert.Zero(t, lockedFor("user3", "10.0.0.2"))
+
+	assert.NoError(t, l.Unlock("user1"))
+	assert.Zero(t, lockedFor("user1", ""))
+	assert.NoError(t, l.UnlockIP("10.0.0.1"))
+	assert.Zero(t, lockedFor("user3", "10.0.0.1"))
+}
+
+func TestSigninLockout(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	lockout := NewLockout(NewMemoryLockoutStore())
+	lockout.FreeFailures, lockout.MaxFailures = 0, 2
+	service := NewAuthService(tp, NewUsers(), Lockouts(lockout),
+		Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+
+	_, err = service.SigninSessionFrom("10.0.0.1", "user1", "wrong password")
+	assert.EqualError(t, err, ErrWrongPassword)
+	// even the right password is refused until the delay passes
+	_, err = service.SigninSessionFrom("10.0.0.1", "user1", "password1")
+	var locked *LockedError
+	assert.True(t, errors.As(err, &locked))
+	assert.Equal(t, 1, locked.RetryAfter())
+	time.Sleep(time.Until(locked.Until))
+
+	// a successful signin forgets failures
+	_, err = service.SigninSessionFrom("10.0.0.1", "user1", "password1")
+	assert.NoError(t, err)
+	_, err = service.SigninSessionFrom("10.0.0.1", "user1", "wrong password")
+	assert.EqualError(t, err, ErrWrongPassword)
+	time.Sleep(time.Second)
+
+	// unknown logins are locked the same way
+	for i := 0; i < 2; i++ {
+		_, err = service.Signin("unknown", "password1")
+		assert.EqualError(t, err, ErrUserNotFound)
+		time.Sleep(time.Second)
+	}
+	_, err = service.Signin("unknown", "password1")
+	assert.True(t, errors.As(err, &locked))
+	assert.Greater(t, locked.RetryAfter(), 60)
+
+	// a password reset unlocks the login
+	_, err = service.SigninSessionFrom("10.0.0.1", "user1", "wrong password")
+	assert.EqualError(t, err, ErrWrongPassword)
+	_, err = service.Signin("user1", "password1")
+	assert.True(t, errors.As(err, &locked))
+	assert.Greater(t, locked.RetryAfter(), 60)
+	reset, err := service.ResetTokens.Issue("user1")
+	assert.NoError(t, err)
+	_, err = service.ResetPassword(reset.Token, "password2")
+	assert.NoError(t, err)
+	_, err = service.Signin("user1", "password2")
+	assert.NoError(t, err)
+}
+
+func TestHandleLockout(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	lockout := NewLockout(NewMemoryLockoutStore())
+	lockout.FreeFailures, lockout.MaxFailures = 0, 1
+	service := NewAuthService(tp, NewUsers(), Lockouts(lockout),
+		Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	for _, login := range []string{"user1", "admin"} {
+		_, err := service.Signup(login, "password1")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, service.GrantRole("admin", "admin"))
+	admin, err := service.Signin("admin", "password1")
+	assert.NoError(t, err)
+	user, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	do := func(path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/signin", "", `{"login": "user1", "password": "wrong"}`).Code)
+	response := do("/auth/signin", "", `{"login": "user1", "password": "password1"}`)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	retryAfter, err := strconv.Atoi(response.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 15*60, retryAfter, 1)
+	assert.JSONEq(t, `{"status": "LOCKED", "retry_after": `+strconv.Itoa(retryAfter)+`}`, response.Body.String())
+
+	// the current password can't be guessed on change either
+	assert.Equal(t, http.StatusTooManyRequests, do("/auth/password/change", user, `{"current_password": "password1", "password": "password2"}`).Code)
+
+	// admins only
+	assert.Equal(t, http.StatusForbidden, do("/auth/unlock", user, `{"login": "user1"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("/auth/unlock", admin, `{}`).Code)
+	assert.Equal(t, http.StatusOK, do("/auth/unlock", admin, `{"login": "user1", "ip": "10.0.0.1"}`).Code)
+	assert.Equal(t, http.StatusOK, do("/auth/signin", "", `{"login": "user1", "password": "password1"}`).Code)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	ErrMailerNotConfigured = "mailer is not configured"
+	ErrMagicLinkInvalid    = "invalid or used magic link"
+)
+
+// SendMagicLink - mails a single-use signin link to a user. Unknown logins are
+// ignored without an error, mail to existing ones may still fail or take a while,
+// so HandleMagicLink sends it in the background not to tell logins apart
+func (s *AuthService) SendMagicLink(ctx context.Context, login string) error {
+	if s.Mailer == nil || s.MagicLinks == nil {
+		return errors.New(ErrMailerNotConfigured)
+	}
+	user, err := s.Users.Get(login)
+	if err != nil {
+		if err.Error() == ErrUserNotFound {
+			return nil
+		}
+		return err
+	}
+
+	token, err := s.MagicLinks.Issue(user.Login)
+	if err != nil {
+		return err
+	}
+	link := s.BaseURL + "/magic-link/verify?token=" + url.QueryEscape(token.Token)
+	return s.Mailer.Send(ctx, Message{
+		To:      s.mailAddress(user),
+		Subject: "Sign in to " + s.Realm,
+		Body: fmt.Sprintf("Follow the link to sign in as %s:\n\n%s\n\nThe link works once and expires at %s.\n"+
+			"If you didn't ask for it, ignore this message.\n", user.Login, link, token.ExpiresAt.Format(time.RFC1123)),
+	})
+}
+
+// MagicLinkLogin - returns the login of a valid magic link without using it up
+func (s *AuthService) MagicLinkLogin(token string) (string, error) {
+	if s.MagicLinks == nil {
+		return "", errors.New(ErrMagicLinkInvalid)
+	}
+	login, err := s.MagicLinks.Login(token)
+	if err != nil {
+		return "", errors.New(ErrMagicLinkInvalid)
+	}
+	return login, nil
+}
+
+// MagicLinkSignin - signs in with the token of a magic link, each link works once,
+// and unlocks a locked out login. Users with mfa enabled get an mfa token,
+// the same as with SigninSession
+func (s *AuthService) MagicLinkSignin(token string) (*Session, error) {
+	if s.MagicLinks == nil {
+		return nil, errors.New(ErrMagicLinkInvalid)
+	}
+	login, err := s.MagicLinks.Redeem(token)
+	if err != nil {
+		return nil, errors.New(ErrMagicLinkInvalid)
+	}
+
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, errors.New(ErrMagicLinkInvalid)
+	}
+	// the owner of the login proved themselves, guesses of the password don't matter
+	if err := s.UnlockSignin(user.Login, ""); err != nil {
+		log.Printf("[WARN] failed to unlock signin of %s, %v", user.Login, err)
+	}
+	// the link was mailed to the email, following it proves the address
+	if s.unverified(user) {
+		err := s.updateUser(user.Login, func(u *User) bool {
+			changed := !u.EmailVerified
+			u.EmailVerified = true
+			return changed
+		})
+		if err != nil {
+			return nil, err
+		}
+		user.EmailVerified = true
+	}
+	return s.completeSignin(user)
+}
+
+// mailAddress returns the address to mail a user at, logins of users
+// without an email are addresses, e.g. of internal users
+func (s *AuthService) mailAddress(user *User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	return user.Login
+}
+
+// mailInBackground runs send for a login after the response of a handler, so neither
+// the time the mail takes nor its failures tell which logins exist. Failures are logged
+func (s *AuthService) mailInBackground(r *http.Request, what, login string, send func(context.Context, string) error) {
+	ctx := context.WithoutCancel(r.Context())
+	s.mailing.Add(1)
+	go func() {
+		defer s.mailing.Done()
+		if err := send(ctx, login); err != nil {
+			log.Printf("[ERROR] failed to send %s to %s, %v", what, login, err)
+		}
+	}()
+}
+
+// WaitMail - waits for mail the handlers send in the background, e.g. on shutdown
+func (s *AuthService) WaitMail() {
+	s.mailing.Wait()
+}
+
+// spentTokens remembers ids of single-use tokens until the tokens expire
+type spentTokens struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// used checks if a token id has been used
+func (t *spentTokens) used(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.ids[id]
+	return ok
+}
+
+// spend marks a token id as used, returns false if it's been used already
+func (t *spentTokens) spend(id string, expiresAt time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.ids == nil {
+		t.ids = map[string]time.Time{}
+	}
+	for k, exp := range t.ids {
+		if now.After(exp) {
+			delete(t.ids, k)
+		}
+	}
+	if _, used := t.ids[id]; used {
+		return false
+	}
+	t.ids[id] = expiresAt
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lastLink returns the link of the last message in an outbox
+func lastLink(t *testing.T, o *Outbox) *url.URL {
+	messages := o.Messages()
+	assert.NotEmpty(t, messages)
+	link := regexp.MustCompile(`https?://\S+`).FindString(messages[len(messages)-1].Body)
+	assert.NotEmpty(t, link)
+	u, err := url.Parse(link)
+	assert.NoError(t, err)
+	return u
+}
+
+func TestMagicLink(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth/"))
+	_, err := service.Signup("user1@example.com", "password1")
+	assert.NoError(t, err)
+	assert.NoError(t, service.GrantRole("user1@example.com", "admin"))
+
+	// unknown logins get no mail and no error
+	assert.NoError(t, service.SendMagicLink(context.Background(), "unknown@example.com"))
+	assert.Empty(t, outbox.Messages())
+
+	assert.NoError(t, service.SendMagicLink(context.Background(), "user1@example.com"))
+	assert.Len(t, outbox.Messages(), 1)
+	assert.Equal(t, "user1@example.com", outbox.Messages()[0].To)
+	link := lastLink(t, outbox)
+	assert.Equal(t, "https://example.com/auth/magic-link/verify", link.Scheme+"://"+link.Host+link.Path)
+	token := link.Query().Get("token")
+
+	// the link token isn't an access token
+	_, err = service.Authenticate(token)
+	assert.Error(t, err)
+
+	// checking the link doesn't use it up
+	login, err := service.MagicLinkLogin(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@example.com", login)
+
+	session, err := service.MagicLinkSignin(token)
+	assert.NoError(t, err)
+	p, err := service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1@example.com", p.Login)
+	assert.Equal(t, []string{"admin"}, p.Roles)
+	assert.NotNil(t, session.Refresh)
+
+	// single use
+	_, err = service.MagicLinkSignin(token)
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+	_, err = service.MagicLinkLogin(token)
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+	// access tokens aren't magic links
+	_, err = service.MagicLinkSignin(session.Access.Token)
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+
+	// a newer link replaces the earlier one
+	assert.NoError(t, service.SendMagicLink(context.Background(), "user1@example.com"))
+	earlier := lastLink(t, outbox).Query().Get("token")
+	assert.NoError(t, service.SendMagicLink(context.Background(), "user1@example.com"))
+	_, err = service.MagicLinkSignin(earlier)
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+
+	// links are forgotten on restart, not accepted again
+	service.MagicLinks = NewMemoryResetTokens(time.Minute)
+	_, err = service.MagicLinkSignin(lastLink(t, outbox).Query().Get("token"))
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+
+	// short-lived
+	service.MagicLinks = NewMemoryResetTokens(-time.Second)
+	assert.NoError(t, service.SendMagicLink(context.Background(), "user1@example.com"))
+	_, err = service.MagicLinkSignin(lastLink(t, outbox).Query().Get("token"))
+	assert.EqualError(t, err, ErrMagicLinkInvalid)
+
+	service.MagicLinks = nil
+	assert.EqualError(t, service.SendMagicLink(context.Background(), "user1@example.com"), ErrMailerNotConfigured)
+	service.Mailer = nil
+	assert.EqualError(t, service.SendMagicLink(context.Background(), "user1@example.com"), ErrMailerNotConfigured)
+}
+
+func TestHandleMagicLink(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth"))
+	_, err := service.Signup("user1@example.com", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	request := func(login string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/magic-link", bytes.NewBufferString(`{"login": "`+login+`"}`))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	// the same response for existing and unknown logins
+	known, unknown := request("user1@example.com"), request("unknown@example.com")
+	service.WaitMail()
+	assert.Equal(t, http.StatusAccepted, known.Code)
+	assert.Equal(t, known.Code, unknown.Code)
+	assert.Equal(t, known.Body.String(), unknown.Body.String())
+	assert.Len(t, outbox.Messages(), 1)
+
+	verify := func(method string, link *url.URL) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, link.RequestURI(), nil)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	// opening the link, e.g. by a link scanner, only renders a form posting the token
+	link := lastLink(t, outbox)
+	for i := 0; i < 2; i++ {
+		response := verify("GET", link)
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Equal(t, "text/html; charset=utf-8", response.Header().Get("Content-Type"))
+		assert.Equal(t, "no-store", response.Header().Get("Cache-Control"))
+		assert.Contains(t, response.Body.String(), `<form method="post">`)
+		assert.Contains(t, response.Body.String(), `value="`+link.Query().Get("token")+`"`)
+		assert.Contains(t, response.Body.String(), "user1@example.com")
+		assert.Empty(t, response.Result().Cookies())
+	}
+	req, _ := http.NewRequest("GET", "/auth/magic-link/verify?token=invalid", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// the form posts the token
+	req, _ = http.NewRequest("POST", "/auth/magic-link/verify", bytes.NewBufferString(url.Values{"token": {link.Query().Get("token")}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	assert.Equal(t, "OK", session["status"])
+	assert.NotEmpty(t, session["refresh_token"])
+	assert.Len(t, response.Result().Cookies(), 2)
+	assert.Equal(t, http.StatusUnauthorized, verify("POST", link).Code)
+	assert.Equal(t, http.StatusUnauthorized, verify("GET", link).Code)
+
+	// users with mfa get an mfa token, the same as on signin
+	enrollment, err := service.EnrollTOTP("user1@example.com")
+	assert.NoError(t, err)
+	_, err = service.ConfirmTOTP("user1@example.com", currentTOTP(t, enrollment.Secret, 0))
+	assert.NoError(t, err)
+	request("user1@example.com")
+	service.WaitMail()
+	response = verify("POST", lastLink(t, outbox))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	assert.Equal(t, "MFA_REQUIRED", session["status"])
+	assert.Empty(t, response.Result().Cookies())
+
+	service.Mailer = nil
+	assert.Equal(t, http.StatusNotImplemented, request("user1@example.com").Code)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is an email message, the body is plain text
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer delivers messages with links, like magic links, to users
+type Mailer interface {
+	// Send() delivers a message
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	// Addr is host:port of the server
+	Addr string
+	From string
+	// Auth is optional, the server has to offer TLS to use PLAIN auth with it
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer - returns a mailer authenticating with PLAIN auth if username is set
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send() sends a message, net/smtp doesn't support cancellation, so the context
+// is checked before sending only
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("invalid recipient %q", msg.To)
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, m.format(msg))
+}
+
+// format builds an RFC 5322 message
+func (m *SMTPMailer) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// Outbox is a stand-in mailer for development and tests, it keeps messages,
+// logs them and appends them to a file as json lines, if the path is set
+type Outbox struct {
+	Path string
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewOutbox(path string) *Outbox {
+	return &Outbox{Path: path}
+}
+
+// Send() keeps a message instead of sending it
+func (o *Outbox) Send(_ context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.Path != "" {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(o.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("[INFO] outbox: %q to %s", msg.Subject, msg.To)
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Messages() returns messages sent so far
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTPServer accepts a single message and sends its envelope and data to the channel
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		var transcript strings.Builder
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				transcript.WriteString(strings.TrimSpace(line) + "\n")
+				reply("250 OK")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 OK")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	m := NewSMTPMailer(addr, "auth@example.com", "", "")
+	assert.NoError(t, m.Send(context.Background(), Message{To: "user1@example.com", Subject: "Sign in", Body: "line1\nline2"}))
+
+	transcript := <-received
+	assert.Contains(t, transcript, "MAIL FROM:<auth@example.com>")
+	assert.Contains(t, transcript, "RCPT TO:<user1@example.com>")
+	assert.Contains(t, transcript, "To: user1@example.com\r\n")
+	assert.Contains(t, transcript, "Subject: Sign in\r\n")
+	assert.Contains(t, transcript, "\r\n\r\nline1\r\nline2")
+
+	assert.Error(t, m.Send(context.Background(), Message{To: "user1@example.com\r\nBcc: evil@example.com"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, m.Send(ctx, Message{To: "user1@example.com"}))
+}
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := NewOutbox(path)
+	assert.NoError(t, o.Send(context.Background(), Message{To: "user1@example.com", Subject: "first"}))
+	assert.NoError(t, o.Send(context.Background(), Message{To: "user2@example.com", Subject: "second"}))
+	assert.Equal(t, []string{"first", "second"}, []string{o.Messages()[0].Subject, o.Messages()[1].Subject})
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var msg Message
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &msg))
+	assert.Equal(t, Message{To: "user2@example.com", Subject: "second"}, msg)
+}
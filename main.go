@@ -1,100 +1,549 @@
 package main
 
 import (
-	"crypto/rand"
 	"errors"
 	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/crypto/argon2"
 )
 
 type User struct {
-	Login    string
-	Password string
+	Login    string   `json:"login"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+	// Attributes are arbitrary user attributes for policy conditions, e.g. org
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// TOTPSecret is a base32 TOTP secret, signin requires a code once it's confirmed
+	TOTPSecret    string `json:"totp_secret,omitempty"`
+	TOTPConfirmed bool   `json:"totp_confirmed,omitempty"`
+	// TOTPLastStep is the time step of the last used code, for replay protection
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are hashes of unused mfa recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Credentials are registered passkeys
+	Credentials []WebAuthnCredential `json:"credentials,omitempty"`
+	// Email is an optional address to mail the user at, signin of users with
+	// an unverified one is subject to AuthService.Unverified
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
 }
 
 type Token struct {
+	ID        string    `json:"jti,omitempty"`
 	Login     string    `json:"login"`
 	Token     string    `json:"token"`
+	IssuedAt  time.Time `json:"issued_at"`
 	ExpiresAt time.Time `json:"expires_at"`
+	Roles     []string  `json:"roles,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	// Purpose restricts a token to a single use case, e.g. completing mfa,
+	// such tokens aren't accepted by Authenticate
+	Purpose string `json:"purpose,omitempty"`
+	// Downscoped marks tokens minted by Downscope, they are accepted by
+	// Authenticate but not by the endpoints managing the account
+	Downscoped bool `json:"downscoped,omitempty"`
+}
+
+// TokenOption is a function that sets optional claims of a new token
+type TokenOption func(*Token)
+
+// WithRoles sets roles of a new token
+func WithRoles(roles ...string) TokenOption {
+	return func(t *Token) {
+		t.Roles = roles
+	}
+}
+
+// WithScopes sets scopes of a new token
+func WithScopes(scopes ...string) TokenOption {
+	return func(t *Token) {
+		t.Scopes = scopes
+	}
+}
+
+// WithPurpose restricts a new token to a given purpose
+func WithPurpose(purpose string) TokenOption {
+	return func(t *Token) {
+		t.Purpose = purpose
+	}
+}
+
+// WithDownscoped marks a new token as minted by Downscope
+func WithDownscoped() TokenOption {
+	return func(t *Token) {
+		t.Downscoped = true
+	}
+}
+
+// WithExpiresAt caps the expiration time of a new token,
+// it never exceeds the provider's expiration time
+func WithExpiresAt(exp time.Time) TokenOption {
+	return func(t *Token) {
+		t.ExpiresAt = exp
+	}
 }
 
 type TokenProvider interface {
-	// New() creates a new token for a given username
-	New(username string) (*Token, error)
+	// New() creates a new token for a given username, with optional claims
+	New(username string, opts ...TokenOption) (*Token, error)
 	// Validate() validates a given token and returns a username
 	Validate(token string) (*Token, error)
 	// Refresh() returns a new token with a new expiration time
 	Refresh(token string) (*Token, error)
 }
 
+// Revoker is implemented by token providers supporting server-side revocation
+type Revoker interface {
+	// Revoke() revokes a given token
+	Revoke(token string) error
+	// RevokeAll() revokes all tokens of a login issued so far
+	RevokeAll(login string) error
+	// CanRevoke() reports if revocation is configured, e.g. a provider may need a store for it
+	CanRevoke() bool
+}
+
 type UserProvider interface {
 	// Get() returns a user by a given username
 	Get(login string) (*User, error)
-	// Create() creates a new user
+	// Create() creates a new user, returns *UserExistsError if the login is taken
 	Create(user User) error
+	// Update() replaces an existing user
+	Update(user User) error
+	// Modify() applies a change to a user and stores it atomically, concurrent
+	// changes of the user wait for each other. Nothing is stored if the change
+	// fails, its error is returned as is. The change runs with the user locked,
+	// it shouldn't do slow work, like hashing
+	Modify(login string, change func(*User) error) error
+	// Delete() deletes a user by a given login
+	Delete(login string) error
+	// List() returns up to `limit` users sorted by login, skipping `offset` users,
+	// and the total number of users
+	List(offset, limit int) ([]User, int, error)
+	// Exists() checks if a user with a given login exists
+	Exists(login string) (bool, error)
+}
+
+// Session is a pair of tokens issued on signin, a short-lived access token
+// and a long-lived refresh token to get the next pair with
+type Session struct {
+	Access  *Token
+	Refresh *Token
+	// MFA is set instead of the tokens above if the user has to complete mfa with VerifyMFA
+	MFA *Token
 }
 
 type AuthService struct {
-	Tokens TokenProvider
-	Users  UserProvider
+	Tokens        TokenProvider
+	Users         UserProvider
+	RefreshTokens RefreshProvider
+	// ResetTokens keeps password reset tokens, nil disables password reset
+	ResetTokens ResetProvider
+	// Lockout slows down password guessing, nil disables it
+	Lockout *Lockout
+	// RateLimiter limits requests to the handlers, nil disables rate limiting
+	RateLimiter *RateLimiter
+	// TrustedProxies are proxies trusted to report client IPs in `X-Forwarded-For`
+	TrustedProxies []netip.Prefix
+	// PasswordPolicy checks new passwords, nil accepts any password
+	PasswordPolicy *PasswordPolicy
+	// Hasher hashes new passwords and verifies stored ones
+	Hasher PasswordHasher
+	// Extractors is a chain of token extractors, the first token found is used
+	Extractors []TokenExtractor
+	// Realm is reported in `WWW-Authenticate` challenges
+	Realm string
+	// Policy makes attribute-based authorization decisions, optional
+	Policy *PolicyEngine
+	// MFATokenTTL is the time to complete mfa after the password is checked
+	MFATokenTTL time.Duration
+	// MFAMaxAttempts is the number of wrong codes an mfa token is revoked after
+	MFAMaxAttempts int
+
+	// WebAuthn is the relying party for passkey login, optional
+	WebAuthn *WebAuthn
+	// Mailer delivers links to users, optional
+	Mailer Mailer
+	// BaseURL is the public URL of the handlers, links in messages point to it
+	BaseURL string
+	// MagicLinks keeps single-use tokens of magic links, nil disables magic links
+	MagicLinks ResetProvider
+	// EmailVerificationTTL is the lifetime of email verification links
+	EmailVerificationTTL time.Duration
+	// Unverified decides what users with an unverified email get on signin
+	Unverified UnverifiedPolicy
+	// UnverifiedScopes are the only scopes of tokens restricted by UnverifiedRestrict
+	UnverifiedScopes []string
+
+	// spent keeps used single-use tokens, like mfa tokens
+	spent spentTokens
+	// mfaFailures counts wrong codes of mfa tokens
+	mfaFailures tokenFailures
+	// mailing counts mail sent in the background by the handlers
+	mailing sync.WaitGroup
+}
+
+func NewAuthService(tp TokenProvider, up UserProvider, opts ...AuthServiceOption) *AuthService {
+	s := &AuthService{
+		Users:                up,
+		Tokens:               tp,
+		RefreshTokens:        NewMemoryRefreshTokens(30 * 24 * time.Hour),
+		ResetTokens:          NewMemoryResetTokens(30 * time.Minute),
+		PasswordPolicy:       DefaultPasswordPolicy(),
+		Lockout:              NewLockout(NewMemoryLockoutStore()),
+		RateLimiter:          NewRateLimiter(DefaultRateLimits()),
+		Hasher:               NewHashers(NewArgon2Hasher(DefaultArgon2Params)),
+		Extractors:           []TokenExtractor{FromAuthorizationHeader(), FromCookie("token")},
+		Realm:                "auth",
+		MFATokenTTL:          5 * time.Minute,
+		MFAMaxAttempts:       5,
+		MagicLinks:           NewMemoryResetTokens(15 * time.Minute),
+		EmailVerificationTTL: 24 * time.Hour,
+		Unverified:           UnverifiedAllow,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// AuthServiceOption is a function that configures an AuthService.
+type AuthServiceOption func(*AuthService)
+
+// Argon2 sets parameters of new argon2id password hashes, existing hashes are
+// rehashed with them on the next successful signin
+func Argon2(p Argon2Params) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Hasher = NewHashers(NewArgon2Hasher(p))
+	}
+}
+
+// Hasher sets the password hasher, e.g. Hashers with a PBKDF2 primary hasher
+func Hasher(h PasswordHasher) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Hasher = h
+	}
 }
 
-func NewAuthService(tp TokenProvider, up UserProvider) *AuthService {
-	return &AuthService{Users: up, Tokens: tp}
+// Passwords sets the policy new passwords are checked with, nil accepts any password
+func Passwords(p *PasswordPolicy) AuthServiceOption {
+	return func(s *AuthService) {
+		s.PasswordPolicy = p
+	}
+}
+
+// Lockouts sets the brute-force protection of signin, nil disables it
+func Lockouts(l *Lockout) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Lockout = l
+	}
+}
+
+// TokenExtractors sets the chain of token extractors, e.g. to accept
+// tokens in a query parameter
+func TokenExtractors(extractors ...TokenExtractor) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Extractors = extractors
+	}
+}
+
+// RefreshTokens sets the refresh token provider, nil disables refresh tokens
+func RefreshTokens(rp RefreshProvider) AuthServiceOption {
+	return func(s *AuthService) {
+		s.RefreshTokens = rp
+	}
+}
+
+// ResetTokens sets the password reset token provider, nil disables password reset
+func ResetTokens(rp ResetProvider) AuthServiceOption {
+	return func(s *AuthService) {
+		s.ResetTokens = rp
+	}
+}
+
+// MagicLinks sets the magic link token provider, nil disables magic links
+func MagicLinks(rp ResetProvider) AuthServiceOption {
+	return func(s *AuthService) {
+		s.MagicLinks = rp
+	}
+}
+
+// Policies sets the policy engine for Authorize and the /authorize endpoint
+func Policies(e *PolicyEngine) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Policy = e
+	}
+}
+
+// Passkeys enables passkey registration and login with a WebAuthn relying party
+func Passkeys(w *WebAuthn) AuthServiceOption {
+	return func(s *AuthService) {
+		s.WebAuthn = w
+	}
+}
+
+// Mail sets the mailer for links to users and the public URL of the handlers
+// the links point to, e.g. https://example.com/auth
+func Mail(m Mailer, baseURL string) AuthServiceOption {
+	return func(s *AuthService) {
+		s.Mailer = m
+		s.BaseURL = strings.TrimSuffix(baseURL, "/")
+	}
 }
 
 const (
+	ErrTokenPurpose  = "token can't be used for authentication"
 	ErrUserNotFound  = "user not found"
+	ErrUserExists    = "user already exists"
 	ErrWrongPassword = "wrong password"
+	ErrReadOnly      = "read-only user provider"
 )
 
-// Signin - signs in a user with a given login and password, returns a token
+// UserExistsError is returned on creating a user with a taken login
+type UserExistsError struct {
+	Login string
+}
+
+func (e *UserExistsError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUserExists, e.Login)
+}
+
+// Signin - signs in a user with a given login and password, returns a token.
+// Users with mfa enabled get *MFARequiredError carrying the mfa token
 func (s *AuthService) Signin(login, password string) (string, error) {
-	user, err := s.Users.Get(login)
+	session, err := s.SigninSession(login, password)
 	if err != nil {
 		return "", err
 	}
+	if session.MFA != nil {
+		return "", &MFARequiredError{Token: session.MFA}
+	}
+	return session.Access.Token, nil
+}
 
-	salt := user.Password[:16]
+// SigninSession - signs in a user with a given login and password,
+// returns an access token and a refresh token, or an mfa token
+// if the user has mfa enabled
+func (s *AuthService) SigninSession(login, password string) (*Session, error) {
+	return s.SigninSessionFrom("", login, password)
+}
 
-	if user.Password != s.Hash(salt, password) {
-		return "", fmt.Errorf("%s: %s", ErrWrongPassword, password)
+// SigninSessionFrom - signs in a user the same way as SigninSession, failed
+// attempts are counted for the login and a given client IP, which may be empty.
+// Returns *LockedError while the login or the IP is locked
+func (s *AuthService) SigninSessionFrom(ip, login, password string) (*Session, error) {
+	if s.Lockout != nil {
+		if err := s.Lockout.Check(login, ip); err != nil {
+			return nil, err
+		}
 	}
-	t, err := s.Tokens.New(login)
+
+	user, err := s.Users.Get(login)
 	if err != nil {
-		return "", err
+		if err.Error() == ErrUserNotFound {
+			s.signinFailed(login, ip)
+		}
+		return nil, err
+	}
+
+	ok, rehash := s.verifyPassword(user.Password, password)
+	if !ok {
+		s.signinFailed(login, ip)
+		return nil, errors.New(ErrWrongPassword)
+	}
+	// with mfa, failures are forgotten once the second factor passes,
+	// else the password would reset the count of wrong codes
+	if s.Lockout != nil && !user.TOTPConfirmed {
+		if err := s.Lockout.Unlock(login); err != nil {
+			log.Printf("[WARN] failed to reset failed signins of %s, %v", login, err)
+		}
+	}
+
+	// hashes made with outdated parameters are replaced while the password is known
+	if rehash {
+		if err := s.rehash(login, user.Password, password); err != nil {
+			log.Printf("[WARN] failed to rehash password of %s, %v", login, err)
+		}
+	}
+
+	return s.completeSignin(user)
+}
+
+// signinFailed counts a failed signin attempt
+func (s *AuthService) signinFailed(login, ip string) {
+	if s.Lockout == nil {
+		return
+	}
+	if err := s.Lockout.Fail(login, ip); err != nil {
+		log.Printf("[WARN] failed to count a failed signin of %s, %v", login, err)
+	}
+}
+
+// completeSignin issues a session to a user who passed the first factor,
+// or an mfa token if the user has mfa enabled
+func (s *AuthService) completeSignin(user *User) (*Session, error) {
+	if user.TOTPConfirmed {
+		mfa, err := s.newMFAToken(user)
+		if err != nil {
+			return nil, err
+		}
+		return &Session{MFA: mfa}, nil
+	}
+	return s.newSession(user)
+}
+
+// Refresh - exchanges a refresh token for a new session, the refresh token
+// is rotated and can't be used again
+func (s *AuthService) Refresh(refreshToken string) (*Session, error) {
+	if s.RefreshTokens == nil {
+		return nil, errors.New(ErrRefreshTokenInvalid)
 	}
-	return t.Token, nil
+
+	rt, err := s.RefreshTokens.Rotate(refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// roles may have changed since the signin
+	user, err := s.Users.Get(rt.Login)
+	if err != nil {
+		return nil, err
+	}
+
+	access, err := s.newAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Access: access, Refresh: rt}, nil
+}
+
+// NewSession - issues an access token and, if enabled, a refresh token
+// for a given login, the caller is responsible for authenticating the user
+func (s *AuthService) NewSession(login string) (*Session, error) {
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, err
+	}
+	return s.newSession(user)
 }
 
-// Signup - creates a user with a given login and password
+func (s *AuthService) newSession(user *User) (*Session, error) {
+	access, err := s.newAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{Access: access}
+	if s.RefreshTokens != nil {
+		if session.Refresh, err = s.RefreshTokens.Issue(user.Login); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// newAccessToken issues an access token carrying claims of a given user,
+// users with an unverified email are subject to the Unverified policy
+func (s *AuthService) newAccessToken(user *User) (*Token, error) {
+	if s.unverified(user) {
+		switch s.Unverified {
+		case UnverifiedReject:
+			return nil, errors.New(ErrEmailNotVerified)
+		case UnverifiedRestrict:
+			return s.Tokens.New(user.Login, WithScopes(s.UnverifiedScopes...))
+		}
+	}
+	return s.Tokens.New(user.Login, WithRoles(user.Roles...), WithScopes(user.Scopes...))
+}
+
+// Signup - creates a user with a given login and password, returns
+// *PasswordPolicyError if the password violates the password policy
 func (s *AuthService) Signup(login, password string) (string, error) {
-	salt := make([]byte, 16)
-	rand.Read(salt)
+	if err := s.checkPassword(login, password); err != nil {
+		return "", err
+	}
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
 
-	s.Users.Create(User{Login: login, Password: s.Hash(string(salt), password)})
+	if err := s.Users.Create(User{Login: login, Password: hash}); err != nil {
+		return "", err
+	}
 	return "", nil
 }
 
+// revoker returns the token provider if it's configured to revoke tokens,
+// a provider that can't is treated the same as one not supporting revocation
+func (s *AuthService) revoker() (Revoker, bool) {
+	r, ok := s.Tokens.(Revoker)
+	if !ok || !r.CanRevoke() {
+		return nil, false
+	}
+	return r, true
+}
+
+// RevokeToken - revokes a given access token, if the token provider supports revocation
+func (s *AuthService) RevokeToken(token string) error {
+	if r, ok := s.revoker(); ok {
+		return r.Revoke(token)
+	}
+	return nil
+}
+
+// LogoutAll - logs a user out everywhere, revoking all access tokens issued
+// so far and all refresh tokens of the login. Without revocation in the token
+// provider access tokens live until they expire, refresh tokens are revoked still
+func (s *AuthService) LogoutAll(login string) error {
+	// refresh tokens go first, so sessions can't be extended
+	// even if access tokens can't be revoked
+	if s.RefreshTokens != nil {
+		if err := s.RefreshTokens.RevokeLogin(login); err != nil {
+			return err
+		}
+	}
+	if r, ok := s.revoker(); ok {
+		return r.RevokeAll(login)
+	}
+	return nil
+}
+
 // Check - checks validity of a token and if such login exists
 func (s *AuthService) Check(token string) (string, error) {
-
-	validated, err := s.Tokens.Validate(token)
+	p, err := s.Authenticate(token)
 	if err != nil {
 		return "", err
 	}
+	return p.Login, nil
+}
 
-	if user, err := s.Users.Get(validated.Login); err == nil {
-		return user.Login, nil
+// Authenticate - validates a token, checks the login exists
+// and returns the principal the token was issued to
+func (s *AuthService) Authenticate(token string) (*Principal, error) {
+	validated, err := s.Tokens.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	if validated.Purpose != "" {
+		return nil, errors.New(ErrTokenPurpose)
 	}
 
-	return "", errors.New(ErrUserNotFound)
-}
+	user, err := s.Users.Get(validated.Login)
+	if err != nil {
+		return nil, errors.New(ErrUserNotFound)
+	}
 
-// Hash - returns `salt` + `salted-hashed password` string
-func (s *AuthService) Hash(salt string, password string) string {
-	key := argon2.IDKey([]byte(password), []byte(salt), 1, 64*1024, 4, 32)
-	return string(salt) + string(key)
+	return &Principal{
+		Login:     user.Login,
+		Token:     validated,
+		ExpiresAt: validated.ExpiresAt,
+		Roles:     validated.Roles,
+		Scopes:    validated.Scopes,
+		// attributes aren't carried by tokens, they may change any time
+		Attributes: user.Attributes,
+		Downscoped: validated.Downscoped,
+	}, nil
 }
@@ -6,29 +6,109 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
 )
 
 func TestSignup(t *testing.T) {
-	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
-	up := NewUsers()
-	service := NewAuthService(tp, up)
-
-	token, err := service.Signup("login", "password")
-	assert.NoError(t, err)
-	assert.Empty(t, token)
+	for name, up := range testUserProviders(t) {
+		t.Run(name, func(t *testing.T) {
+			tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+			service := NewAuthService(tp, up)
+
+			token, err := service.Signup("login", "password")
+			assert.NoError(t, err)
+			assert.Empty(t, token)
+		})
+	}
 }
 
 func TestSignin(t *testing.T) {
+	for name, up := range testUserProviders(t) {
+		t.Run(name, func(t *testing.T) {
+			tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+			service := NewAuthService(tp, up)
+
+			token, err := service.Signin("login", "password")
+			assert.Error(t, err)
+			assert.Empty(t, token)
+		})
+	}
+}
+
+func TestSignupSignin(t *testing.T) {
+	for name, up := range testUserProviders(t) {
+		t.Run(name, func(t *testing.T) {
+			tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+			service := NewAuthService(tp, up)
+
+			_, err := service.Signup("login", "password")
+			assert.NoError(t, err)
+
+			token, err := service.Signin("login", "password")
+			assert.NoError(t, err)
+			assert.NotEmpty(t, token)
+
+			result, err := service.Check(token)
+			assert.NoError(t, err)
+			assert.NotEmpty(t, result)
+			assert.Equal(t, "login", result)
+
+			token, err = service.Signin("wrong login", "password")
+			assert.Error(t, err)
+			assert.Empty(t, token)
+
+			token, err = service.Signin("login", "wrong password")
+			assert.Error(t, err)
+			assert.Empty(t, token)
+
+			token, err = service.Signin("wrong login", "wrong password")
+			assert.Error(t, err)
+			assert.Empty(t, token)
+		})
+	}
+}
+
+func TestStaticUsers(t *testing.T) {
+
+	// Service just to hash passwords
 	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
 	up := NewUsers()
 	service := NewAuthService(tp, up)
 
-	token, err := service.Signin("login", "password")
+	hash := func(password string) string {
+		h, err := service.Hasher.Hash(password)
+		assert.NoError(t, err)
+		return h
+	}
+
+	// Create a map of users
+	users := make(map[string]User, 3)
+	users["user1"] = User{Login: "user1", Password: hash("password1")}
+	users["user2"] = User{Login: "user2", Password: hash("password2")}
+	users["user3"] = User{Login: "user3", Password: hash("password3")}
+
+	// test AuthService wiер static users provider
+	sup := NewStaticUsers(users)
+	s := NewAuthService(tp, sup)
+
+	token, err := s.Signin("user1", "password1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	token, err = s.Signin("user2", "password2")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	token, err = s.Signin("user3", "password3")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	token, err = s.Signin("user_unknown", "password_unknown")
 	assert.Error(t, err)
 	assert.Empty(t, token)
 }
 
-func TestSignupSignin(t *testing.T) {
+func TestSigninSessionRefresh(t *testing.T) {
 	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
 	up := NewUsers()
 	service := NewAuthService(tp, up)
@@ -36,58 +116,94 @@ func TestSignupSignin(t *testing.T) {
 	_, err := service.Signup("login", "password")
 	assert.NoError(t, err)
 
-	token, err := service.Signin("login", "password")
+	session, err := service.SigninSession("login", "password")
 	assert.NoError(t, err)
-	assert.NotEmpty(t, token)
+	assert.NotEmpty(t, session.Access.Token)
+	assert.NotEmpty(t, session.Refresh.Token)
 
-	result, err := service.Check(token)
+	refreshed, err := service.Refresh(session.Refresh.Token)
 	assert.NoError(t, err)
-	assert.NotEmpty(t, result)
-	assert.Equal(t, "login", result)
+	assert.NotEqual(t, session.Refresh.Token, refreshed.Refresh.Token)
 
-	token, err = service.Signin("wrong login", "password")
-	assert.Error(t, err)
-	assert.Empty(t, token)
+	login, err := service.Check(refreshed.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "login", login)
 
-	token, err = service.Signin("login", "wrong password")
+	// refresh token can be used only once
+	_, err = service.Refresh(session.Refresh.Token)
 	assert.Error(t, err)
-	assert.Empty(t, token)
 
-	token, err = service.Signin("wrong login", "wrong password")
+	// and its reuse revoked the family
+	_, err = service.Refresh(refreshed.Refresh.Token)
 	assert.Error(t, err)
-	assert.Empty(t, token)
-}
 
-func TestStaticUsers(t *testing.T) {
+	// refresh tokens disabled
+	service = NewAuthService(tp, up, RefreshTokens(nil))
+	session, err = service.SigninSession("login", "password")
+	assert.NoError(t, err)
+	assert.Nil(t, session.Refresh)
+}
 
-	// Service just to hash passwords
+func TestMigratePlaintextPasswords(t *testing.T) {
 	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
 	up := NewUsers()
 	service := NewAuthService(tp, up)
 
-	// Create a map of users
-	users := make(map[string]User, 3)
-	users["user1"] = User{Login: "user1", Password: service.Hash("salt456789012345", "password1")}
-	users["user2"] = User{Login: "user2", Password: service.Hash("salt456789012345", "password2")}
-	users["user3"] = User{Login: "user3", Password: service.Hash("salt456789012345", "password3")}
+	// records stored in plaintext by older versions of the http handlers
+	assert.NoError(t, up.Create(User{Login: "plain1", Password: "password1"}))
+	assert.NoError(t, up.Create(User{Login: "plain2", Password: "password2"}))
+	_, err := service.Signup("hashed", "password3")
+	assert.NoError(t, err)
+	hashed, err := up.Get("hashed")
+	assert.NoError(t, err)
 
-	// test AuthService wiер static users provider
-	sup := NewStaticUsers(users)
-	s := NewAuthService(tp, sup)
+	// legacy hashes of random salts may start with `$`
+	salt := "$alt456789012345"
+	legacy := salt + string(argon2.IDKey([]byte("password4"), []byte(salt), 1, 64*1024, 4, 32))
+	assert.NoError(t, up.Create(User{Login: "legacy", Password: legacy}))
 
-	token, err := s.Signin("user1", "password1")
+	// plaintext records can't be used to sign in
+	_, err = service.Signin("plain1", "password1")
+	assert.EqualError(t, err, ErrWrongPassword)
+
+	// a dry run changes nothing
+	res, err := service.MigratePlaintextPasswords(true)
 	assert.NoError(t, err)
-	assert.NotEmpty(t, token)
+	assert.ElementsMatch(t, []string{"plain1", "plain2"}, res.Migrated)
+	assert.Equal(t, []string{"legacy"}, res.Ambiguous)
+	user, err := up.Get("plain1")
+	assert.NoError(t, err)
+	assert.Equal(t, "password1", user.Password)
 
-	token, err = s.Signin("user2", "password2")
+	res, err = service.MigratePlaintextPasswords(false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"plain1", "plain2"}, res.Migrated)
+
+	user, err = up.Get("plain1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "password1", user.Password)
+
+	token, err := service.Signin("plain1", "password1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+	token, err = service.Signin("plain2", "password2")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, token)
 
-	token, err = s.Signin("user3", "password3")
+	// hashed records are left as is
+	user, err = up.Get("hashed")
+	assert.NoError(t, err)
+	assert.Equal(t, hashed.Password, user.Password)
+	user, err = up.Get("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, user.Password)
+	token, err = service.Signin("legacy", "password4")
 	assert.NoError(t, err)
 	assert.NotEmpty(t, token)
 
-	token, err = s.Signin("user_unknown", "password_unknown")
-	assert.Error(t, err)
-	assert.Empty(t, token)
+	// nothing left to migrate
+	res, err = service.MigratePlaintextPasswords(false)
+	assert.NoError(t, err)
+	assert.Empty(t, res.Migrated)
+	assert.Empty(t, res.Ambiguous)
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// verifyPassword checks a password against a stored hash, `rehash` is true
+// if the hash is valid, but has to be replaced with one of the primary hasher
+func (s *AuthService) verifyPassword(stored, password string) (ok, rehash bool) {
+	ok, err := s.Hasher.Verify(stored, password)
+	if err != nil {
+		log.Printf("[DEBUG] failed to verify password hash, %v", err)
+		return false, false
+	}
+	return ok, ok && s.Hasher.NeedsRehash(stored)
+}
+
+// checkPassword checks a new password of a login with the password policy, if any
+func (s *AuthService) checkPassword(login, password string) error {
+	if s.PasswordPolicy == nil {
+		return nil
+	}
+	return s.PasswordPolicy.Check(login, password)
+}
+
+// rehash replaces the stored hash of a user, the password is known to be correct.
+// The hash is kept if it's changed from `stored` meanwhile, e.g. by a password change
+func (s *AuthService) rehash(login, stored, password string) error {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.updateUser(login, func(u *User) bool {
+		if u.Password != stored {
+			return false
+		}
+		u.Password = hash
+		return true
+	})
+}
+
+// setPassword hashes and stores a new password of a user, other fields of the user
+// are written as they are in the store, not as they were when the request started
+func (s *AuthService) setPassword(login, password string) error {
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return s.updateUser(login, func(u *User) bool {
+		u.Password = hash
+		return true
+	})
+}
+
+// PasswordMigration is the result of MigratePlaintextPasswords
+type PasswordMigration struct {
+	// Migrated are logins with plaintext passwords, hashed unless it's a dry run
+	Migrated []string
+	// Ambiguous are logins with passwords of the length of a legacy argon2 hash,
+	// such a password can't be told apart from a plaintext one and is left as is
+	Ambiguous []string
+}
+
+// MigratePlaintextPasswords - hashes passwords stored in plaintext by early
+// versions of the http handlers. It's a one-off migration, a dry run only
+// lists the users to migrate. Passwords of no known hash format are taken
+// for plaintext, except the ones that may be legacy argon2 hashes
+func (s *AuthService) MigratePlaintextPasswords(dryRun bool) (*PasswordMigration, error) {
+	const pageSize = 100
+	res := &PasswordMigration{}
+	for offset := 0; ; offset += pageSize {
+		users, total, err := s.Users.List(offset, pageSize)
+		if err != nil {
+			return res, err
+		}
+		for _, user := range users {
+			switch {
+			case legacyArgon2Hasher{}.Recognizes(user.Password):
+				res.Ambiguous = append(res.Ambiguous, user.Login)
+				continue
+			case s.Hasher.Recognizes(user.Password):
+				continue
+			}
+			if !dryRun {
+				if err := s.rehash(user.Login, user.Password, user.Password); err != nil {
+					return res, fmt.Errorf("failed to migrate %s: %w", user.Login, err)
+				}
+			}
+			res.Migrated = append(res.Migrated, user.Login)
+		}
+		if offset+pageSize >= total {
+			return res, nil
+		}
+	}
+}
+
+// ChangePassword - replaces the password of a user who knows the current one,
+// the new password is checked with the password policy and hashed with
+// the primary hasher. With logoutOthers all sessions of the user are revoked
+// and a new session is returned to replace the caller's one, otherwise
+// the returned session is nil
+func (s *AuthService) ChangePassword(login, current, password string, logoutOthers bool) (*Session, error) {
+	return s.ChangePasswordFrom("", login, current, password, logoutOthers)
+}
+
+// ChangePasswordFrom - ChangePassword of a client with a given IP, which may be empty.
+// Wrong current passwords count as failed signins of the login and the IP.
+// Returns *LockedError while the login or the IP is locked
+func (s *AuthService) ChangePasswordFrom(ip, login, current, password string, logoutOthers bool) (*Session, error) {
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, err
+	}
+	if s.Lockout != nil {
+		if err := s.Lockout.Check(login, ip); err != nil {
+			return nil, err
+		}
+	}
+	if ok, _ := s.verifyPassword(user.Password, current); !ok {
+		s.signinFailed(login, ip)
+		return nil, errors.New(ErrWrongPassword)
+	}
+	if err := s.checkPassword(login, password); err != nil {
+		return nil, err
+	}
+	if !logoutOthers {
+		return nil, s.setPassword(login, password)
+	}
+
+	// sessions are revoked first, so the password stays if revocation fails
+	if err := s.LogoutAll(login); err != nil {
+		return nil, err
+	}
+	if err := s.setPassword(login, password); err != nil {
+		return nil, err
+	}
+	if user, err = s.Users.Get(login); err != nil {
+		return nil, err
+	}
+	return s.newSession(user)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestRehashOnSignin(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+	up := NewUsers()
+	weak := Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+	strong := Argon2Params{Time: 2, Memory: 16 * 1024, Threads: 2, SaltLen: 16, KeyLen: 32}
+
+	_, err := NewAuthService(tp, up, Argon2(weak)).Signup("login", "password")
+	assert.NoError(t, err)
+
+	// parameters were raised, the hash is upgraded on signin
+	service := NewAuthService(tp, up, Argon2(strong))
+	_, err = service.Signin("login", "wrong password")
+	assert.Error(t, err)
+	user, err := up.Get("login")
+	assert.NoError(t, err)
+	assert.Contains(t, user.Password, "$m=8192,t=1,p=1$")
+
+	_, err = service.Signin("login", "password")
+	assert.NoError(t, err)
+	user, err = up.Get("login")
+	assert.NoError(t, err)
+	assert.Contains(t, user.Password, "$m=16384,t=2,p=2$")
+
+	token, err := service.Signin("login", "password")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	// hash in the format before PHC strings
+	salt := "salt456789012345"
+	legacy := salt + string(argon2.IDKey([]byte("password"), []byte(salt), 1, 64*1024, 4, 32))
+	assert.NoError(t, up.Create(User{Login: "legacy", Password: legacy}))
+
+	_, err = service.Signin("legacy", "wrong password")
+	assert.Error(t, err)
+	_, err = service.Signin("legacy", "password")
+	assert.NoError(t, err)
+	user, err = up.Get("legacy")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(user.Password, "$argon2id$v=19$m=16384,t=2,p=2$"))
+
+	// read-only providers can't be rehashed, signin still works
+	static := NewAuthService(tp, NewStaticUsers(map[string]User{"static": {Login: "static", Password: legacy}}), Argon2(strong))
+	token, err = static.Signin("static", "password")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+}
+
+func TestImportedHashesUpgrade(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(3*time.Second), Key("my_secret_key"))
+	up := NewUsers()
+	service := NewAuthService(tp, up, Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+
+	// users imported from a legacy system, hashed with its defaults
+	bcryptHash, err := NewBcryptHasher(4).Hash("password")
+	assert.NoError(t, err)
+	scryptHash, err := NewScryptHasher(ScryptParams{LogN: 10, R: 8, P: 1, SaltLen: 16, KeyLen: 32}).Hash("password")
+	assert.NoError(t, err)
+	pbkdf2Hash, err := NewPBKDF2Hasher(PBKDF2Params{Iterations: 1000, SaltLen: 16, KeyLen: 32}).Hash("password")
+	assert.NoError(t, err)
+
+	for login, hash := range map[string]string{"bcrypt": bcryptHash, "scrypt": scryptHash, "pbkdf2": pbkdf2Hash} {
+		assert.NoError(t, up.Create(User{Login: login, Password: hash}))
+
+		_, err = service.Signin(login, "wrong password")
+		assert.EqualError(t, err, ErrWrongPassword, login)
+		user, err := up.Get(login)
+		assert.NoError(t, err)
+		assert.Equal(t, hash, user.Password, login)
+
+		token, err := service.Signin(login, "password")
+		assert.NoError(t, err, login)
+		assert.NotEmpty(t, token, login)
+
+		// upgraded to the primary algorithm
+		user, err = up.Get(login)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(user.Password, "$argon2id$"), login)
+
+		_, err = service.Signin(login, "password")
+		assert.NoError(t, err, login)
+	}
+
+	// unknown format
+	assert.NoError(t, up.Create(User{Login: "unknown", Password: "$md5$password"}))
+	_, err = service.Signin("unknown", "$md5$password")
+	assert.EqualError(t, err, ErrWrongPassword)
+}
+
+func TestChangePassword(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	up := NewUsers()
+	weak := Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+	_, err := NewAuthService(tp, up, Argon2(weak)).Signup("login", "password")
+	assert.NoError(t, err)
+
+	service := NewAuthService(tp, up, Argon2(Argon2Params{Time: 2, Memory: 16 * 1024, Threads: 2, SaltLen: 16, KeyLen: 32}))
+	other, err := service.SigninSession("login", "password")
+	assert.NoError(t, err)
+
+	_, err = service.ChangePassword("login", "wrong password", "password2", false)
+	assert.EqualError(t, err, ErrWrongPassword)
+	_, err = service.ChangePassword("unknown", "password", "password2", false)
+	assert.EqualError(t, err, ErrUserNotFound)
+
+	// the new password is hashed with the current parameters, sessions stay
+	session, err := service.ChangePassword("login", "password", "password2", false)
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+	user, err := up.Get("login")
+	assert.NoError(t, err)
+	assert.Contains(t, user.Password, "$m=16384,t=2,p=2$")
+	_, err = service.Signin("login", "password")
+	assert.EqualError(t, err, ErrWrongPassword)
+	_, err = service.Check(other.Access.Token)
+	assert.NoError(t, err)
+
+	// other sessions are revoked, the caller gets a new one
+	session, err = service.ChangePassword("login", "password2", "password3", true)
+	assert.NoError(t, err)
+	_, err = service.Check(other.Access.Token)
+	assert.EqualError(t, err, ErrTokenRevoked)
+	_, err = service.Refresh(other.Refresh.Token)
+	assert.Error(t, err)
+	login, err := service.Check(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "login", login)
+	_, err = service.Refresh(session.Refresh.Token)
+	assert.NoError(t, err)
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	lockout := NewLockout(NewMemoryLockoutStore())
+	lockout.FreeFailures, lockout.IPMaxFailures = 10, 1
+	service := NewAuthService(tp, NewUsers(), Lockouts(lockout),
+		Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	_, err = service.Signup("user2", "password2")
+	assert.NoError(t, err)
+
+	// a wrong current password counts as a failure of the client IP too
+	_, err = service.ChangePasswordFrom("10.0.0.1", "user1", "wrong password", "password3", false)
+	assert.EqualError(t, err, ErrWrongPassword)
+	var locked *LockedError
+	_, err = service.ChangePasswordFrom("10.0.0.1", "user1", "password1", "password3", false)
+	assert.True(t, errors.As(err, &locked))
+	_, err = service.SigninSessionFrom("10.0.0.1", "user2", "password2")
+	assert.True(t, errors.As(err, &locked))
+
+	// other clients aren't locked
+	_, err = service.ChangePasswordFrom("10.0.0.2", "user1", "password1", "password3", false)
+	assert.NoError(t, err)
+}
+
+// racyUsers changes a user right after it's read once, like a concurrent request would
+type racyUsers struct {
+	UserProvider
+	race func()
+}
+
+func (r *racyUsers) Get(login string) (*User, error) {
+	user, err := r.UserProvider.Get(login)
+	if race := r.race; race != nil {
+		r.race = nil
+		race()
+	}
+	return user, err
+}
+
+func TestChangePasswordConcurrentUpdate(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	up := &racyUsers{UserProvider: NewUsers()}
+	service := NewAuthService(tp, up, Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("login", "password")
+	assert.NoError(t, err)
+
+	// a role granted while the password is being verified is kept
+	up.race = func() { assert.NoError(t, service.GrantRole("login", "admin")) }
+	session, err := service.ChangePassword("login", "password", "password2", true)
+	assert.NoError(t, err)
+	user, err := up.Get("login")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, user.Roles)
+	p, err := service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, p.Roles)
+
+	// a rehash doesn't replace a hash changed meanwhile
+	assert.NoError(t, service.rehash("login", "stale hash", "password"))
+	_, err = service.Signin("login", "password2")
+	assert.NoError(t, err)
+}
+
+func TestHandlePasswordChange(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	service := NewAuthService(tp, NewUsers(), Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("login", "password")
+	assert.NoError(t, err)
+	token, err := service.Signin("login", "password")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	do := func(token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/password/change", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("", `{"current_password": "password", "password": "password2"}`).Code)
+	assert.Equal(t, http.StatusForbidden, do(token, `{"current_password": "wrong", "password": "password2"}`).Code)
+
+	response := do(token, `{"current_password": "password", "password": "password2"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Result().Cookies())
+
+	response = do(token, `{"current_password": "password2", "password": "password3", "logout_others": true}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	assert.Equal(t, "OK", session["status"])
+	assert.NotEmpty(t, session["token"])
+	assert.NotEmpty(t, session["refresh_token"])
+
+	_, err = service.Signin("login", "password3")
+	assert.NoError(t, err)
+}
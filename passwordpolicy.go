@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const ErrWeakPassword = "password violates the password policy"
+
+// password policy rules, reported in violations
+const (
+	RuleMinLength   = "min_length"
+	RuleMaxLength   = "max_length"
+	RuleClasses     = "character_classes"
+	RuleLogin       = "login"
+	RuleStrength    = "strength"
+	RuleCompromised = "compromised"
+)
+
+// PasswordPolicy checks new passwords on signup, change and reset
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+	// MaxLength is the maximum number of bytes, hashing a huge password
+	// with argon2 is a cheap way to load the server
+	MaxLength int
+	// MinClasses is the minimum number of character classes used,
+	// out of lowercase and uppercase letters, digits and others
+	MinClasses int
+	// DisallowLogin rejects passwords equal to the login, ignoring case
+	DisallowLogin bool
+	// MinStrength is the minimum score of PasswordStrength, 0 to 4
+	MinStrength int
+	// Compromised is a list of known passwords, see LoadCompromisedPasswords
+	Compromised *CompromisedPasswords
+}
+
+// DefaultPasswordPolicy - returns the policy AuthService uses by default
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: 8, MaxLength: 1024, DisallowLogin: true}
+}
+
+// PasswordViolation is a rule a password doesn't satisfy
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a password violates
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+	// Strength is the score of the password, 0 to 4
+	Strength int
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return fmt.Sprintf("%s: %s", ErrWeakPassword, strings.Join(messages, "; "))
+}
+
+// Check() returns *PasswordPolicyError if a password of a given login violates the policy
+func (p *PasswordPolicy) Check(login, password string) error {
+	var violations []PasswordViolation
+	add := func(rule, format string, args ...any) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// nothing else is checked in a password too long to be worth the time
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		add(RuleMaxLength, "password must be at most %d bytes long", p.MaxLength)
+		return &PasswordPolicyError{Violations: violations}
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		add(RuleMinLength, "password must be at least %d characters long", p.MinLength)
+	}
+	if characterClasses(password) < p.MinClasses {
+		add(RuleClasses, "password must use at least %d of lowercase, uppercase, digits and other characters", p.MinClasses)
+	}
+	if p.DisallowLogin && login != "" && strings.EqualFold(password, login) {
+		add(RuleLogin, "password must differ from the login")
+	}
+	if p.Compromised.Contains(password) {
+		add(RuleCompromised, "password is known to be compromised")
+	}
+	strength := PasswordStrength(password, p.Compromised)
+	if strength < p.MinStrength {
+		add(RuleStrength, "password is too weak, strength %d of at least %d", strength, p.MinStrength)
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations, Strength: strength}
+	}
+	return nil
+}
+
+// characterClasses counts classes of characters used, out of lowercase and
+// uppercase letters, digits and others
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// PasswordStrength - estimates the strength of a password as a score from 0,
+// trivially guessable, to 4, very hard to guess, like zxcvbn scores. The estimate
+// is the entropy of random characters of the classes used, with repeated and
+// sequential characters and known passwords counted as nearly free
+func PasswordStrength(password string, known *CompromisedPasswords) int {
+	bits := passwordEntropy(password, known)
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 40:
+		return 1
+	case bits < 55:
+		return 2
+	case bits < 70:
+		return 3
+	}
+	return 4
+}
+
+// passwordEntropy estimates the number of bits of a password, a known password
+// takes a guess out of the known ones
+func passwordEntropy(password string, known *CompromisedPasswords) float64 {
+	if known.Contains(password) {
+		return math.Log2(float64(known.Len() + 1))
+	}
+
+	pool := 0
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			pool |= 1
+		case r >= 'A' && r <= 'Z':
+			pool |= 2
+		case r >= '0' && r <= '9':
+			pool |= 4
+		case r < utf8.RuneSelf:
+			pool |= 8
+		default:
+			pool |= 16
+		}
+	}
+	size := 0
+	for bit, n := range []int{26, 26, 10, 33, 100} {
+		if pool&(1<<bit) != 0 {
+			size += n
+		}
+	}
+
+	bits := 0.0
+	prev := rune(-1)
+	for _, r := range password {
+		if r == prev || r == prev+1 || r == prev-1 {
+			bits++
+		} else {
+			bits += math.Log2(float64(size))
+		}
+		prev = r
+	}
+	return bits
+}
+
+// CompromisedPasswords is a set of known passwords, e.g. of breaches or
+// common password lists. A nil set is empty
+type CompromisedPasswords struct {
+	plain  map[string]struct{} // lowercase
+	hashes map[string]struct{} // uppercase hex SHA-1
+}
+
+// LoadCompromisedPasswords - loads known passwords from a file, a password or
+// an uppercase hex SHA-1 of a password per line, optionally followed by `:count`,
+// as in Pwned Passwords downloads. Empty lines and lines starting with # are skipped,
+// plain passwords match ignoring case
+func LoadCompromisedPasswords(path string) (*CompromisedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &CompromisedPasswords{plain: map[string]struct{}{}, hashes: map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			c.hashes[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		c.plain[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Contains() checks if a password is known
+func (c *CompromisedPasswords) Contains(password string) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.plain[strings.ToLower(password)]; ok {
+		return true
+	}
+	if len(c.hashes) == 0 {
+		return false
+	}
+	sum := sha1.Sum([]byte(password))
+	_, ok := c.hashes[strings.ToUpper(hex.EncodeToString(sum[:]))]
+	return ok
+}
+
+// Len() returns the number of known passwords
+func (c *CompromisedPasswords) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.plain) + len(c.hashes)
+}
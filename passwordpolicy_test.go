@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// violatedRules returns rules of a *PasswordPolicyError
+func violatedRules(t *testing.T, err error) []string {
+	var weak *PasswordPolicyError
+	assert.True(t, errors.As(err, &weak), "expected a password policy error, got %v", err)
+	rules := make([]string, len(weak.Violations))
+	for i, v := range weak.Violations {
+		rules[i] = v.Rule
+	}
+	return rules
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := DefaultPasswordPolicy()
+	assert.NoError(t, p.Check("user1", "password1"))
+	assert.Equal(t, []string{RuleMinLength}, violatedRules(t, p.Check("user1", "")))
+	assert.Equal(t, []string{RuleLogin}, violatedRules(t, p.Check("longlogin", "LongLogin")))
+	assert.Equal(t, []string{RuleMaxLength}, violatedRules(t, p.Check("user1", strings.Repeat("a", 1025))))
+
+	// every violated rule is listed
+	p = &PasswordPolicy{MinLength: 12, MinClasses: 3, DisallowLogin: true, MinStrength: 3}
+	err := p.Check("user1", "user1")
+	assert.Equal(t, []string{RuleMinLength, RuleClasses, RuleLogin, RuleStrength}, violatedRules(t, err))
+	assert.Contains(t, err.Error(), ErrWeakPassword)
+	assert.Contains(t, err.Error(), "at least 12 characters")
+	assert.NoError(t, p.Check("user1", "correct Horse battery staple 9"))
+}
+
+func TestPasswordStrength(t *testing.T) {
+	for password, score := range map[string]int{
+		"":                             0,
+		"aaaaaaaaaaaa":                 0,
+		"12345678":                     0,
+		"abcdefghijkl":                 0,
+		"qwertyui":                     1,
+		"password1":                    2,
+		"Tr0ub4dor&3":                  4,
+		"correct horse battery staple": 4,
+	} {
+		assert.Equal(t, score, PasswordStrength(password, nil), password)
+	}
+}
+
+func TestCompromisedPasswords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords.txt")
+	// SHA-1 of "Tr0ub4dor&3" in the Pwned Passwords format
+	assert.NoError(t, os.WriteFile(path, []byte("# common passwords\n\nPassword1\nqwerty123\n"+
+		"874572E7A5AE6A49466A6AC578B98ADBA78C6AA6:42\n"), 0o600))
+	known, err := LoadCompromisedPasswords(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, known.Len())
+
+	assert.True(t, known.Contains("password1"))
+	assert.True(t, known.Contains("QWERTY123"))
+	assert.False(t, known.Contains("qwerty1234"))
+	assert.True(t, known.Contains("Tr0ub4dor&3"))
+	assert.False(t, known.Contains("tr0ub4dor&3"))
+
+	// known passwords are weak, however random they look
+	assert.Equal(t, 0, PasswordStrength("password1", known))
+
+	p := DefaultPasswordPolicy()
+	p.Compromised = known
+	assert.Equal(t, []string{RuleCompromised}, violatedRules(t, p.Check("user1", "Password1")))
+	assert.NoError(t, p.Check("user1", "password2"))
+
+	var nothing *CompromisedPasswords
+	assert.False(t, nothing.Contains("password1"))
+	_, err = LoadCompromisedPasswords(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
+
+func TestPasswordPolicyEndpoints(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers(), Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	handler := service.Handlers("/auth")
+
+	do := func(path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	response := do("/auth/signup", "", `{"login": "user1", "password": "user1"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	var weak struct {
+		Status     string              `json:"status"`
+		Violations []PasswordViolation `json:"violations"`
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&weak))
+	assert.Equal(t, "WEAK_PASSWORD", weak.Status)
+	assert.Len(t, weak.Violations, 2)
+	assert.Equal(t, RuleMinLength, weak.Violations[0].Rule)
+	assert.Equal(t, RuleLogin, weak.Violations[1].Rule)
+	_, err := service.Users.Get("user1")
+	assert.EqualError(t, err, ErrUserNotFound)
+
+	assert.Equal(t, http.StatusOK, do("/auth/signup", "", `{"login": "user1", "password": "password1"}`).Code)
+	token, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, do("/auth/password/change", token, `{"current_password": "password1", "password": "short"}`).Code)
+
+	// a weak password doesn't use the reset token up
+	reset, err := service.ResetTokens.Issue("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, do("/auth/password/reset", "", `{"token": "`+reset.Token+`", "password": "short"}`).Code)
+	assert.Equal(t, http.StatusOK, do("/auth/password/reset", "", `{"token": "`+reset.Token+`", "password": "password2"}`).Code)
+
+	// the policy is optional
+	service.PasswordPolicy = nil
+	_, err = service.Signup("user2", "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ErrAccessDenied        = "access denied"
+	ErrPolicyNotConfigured = "policy engine is not configured"
+)
+
+// Policy is a set of rules, an action is allowed if at least one allow rule
+// matches it and no deny rule does. A policy file looks like
+//
+//	rules:
+//	  - id: edit-own-org-documents
+//	    effect: allow
+//	    actions: ["documents:edit"]
+//	    resources: ["document"]
+//	    roles: ["editor"]
+//	    when:
+//	      - resource.attributes.org == principal.attributes.org
+//	      - request.weekday in [1, 2, 3, 4, 5]
+//	      - request.hour >= 9
+//	      - request.hour < 18
+//
+// JSON files with the same structure are accepted as well
+type Policy struct {
+	Rules []PolicyRule `yaml:"rules" json:"rules"`
+}
+
+// PolicyRule matches actions on resources of given types by principals with any
+// of given roles, if all of its conditions hold. Actions and resource types are
+// matched as scopes, so `documents:*` matches `documents:edit`. Empty resources
+// or roles match any
+type PolicyRule struct {
+	ID        string   `yaml:"id" json:"id"`
+	Effect    string   `yaml:"effect" json:"effect"`
+	Actions   []string `yaml:"actions" json:"actions"`
+	Resources []string `yaml:"resources" json:"resources"`
+	Roles     []string `yaml:"roles" json:"roles"`
+	// When is a list of conditions `<operand> <operator> <operand>`, operands are
+	// attributes (`principal.login`, `principal.roles`, `principal.attributes.<name>`,
+	// `resource.type`, `resource.id`, `resource.attributes.<name>`, `action`,
+	// `request.method`, `request.path`, `request.ip`, `request.hour`, `request.weekday`)
+	// or literals ('text', 42, true, [1, 2]); operators are ==, !=, <, <=, >, >=,
+	// in and contains. A condition with a missing attribute never holds
+	When []string `yaml:"when" json:"when"`
+
+	conditions []condition
+}
+
+// Resource is the subject of an authorization decision
+type Resource struct {
+	Type       string         `json:"type"`
+	ID         string         `json:"id,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+// PolicyInput is everything a decision is made on
+type PolicyInput struct {
+	Principal *Principal
+	Action    string
+	Resource  Resource
+	// Request holds request attributes, e.g. method, path and ip
+	Request map[string]any
+}
+
+// Decision is a result of evaluating a policy
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the id of the rule the decision is made by, empty if no rule matched
+	Rule string `json:"rule,omitempty"`
+}
+
+// ParsePolicy - parses a policy in YAML or JSON and compiles its conditions
+func ParsePolicy(data []byte) (*Policy, error) {
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.ID == "" {
+			rule.ID = fmt.Sprintf("rule-%d", i+1)
+		}
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("rule %s: effect has to be allow or deny, got %q", rule.ID, rule.Effect)
+		}
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("rule %s: no actions", rule.ID)
+		}
+		for _, expr := range rule.When {
+			c, err := parseCondition(expr)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.ID, err)
+			}
+			rule.conditions = append(rule.conditions, c)
+		}
+	}
+	return &p, nil
+}
+
+// Decide - evaluates the policy, deny rules take precedence over allow rules
+// and nothing is allowed by default
+func (p *Policy) Decide(in PolicyInput, now time.Time) Decision {
+	env := policyEnv(in, now)
+	var allowed *PolicyRule
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.matches(in, env) {
+			continue
+		}
+		if rule.Effect == "deny" {
+			return Decision{Allowed: false, Rule: rule.ID}
+		}
+		if allowed == nil {
+			allowed = rule
+		}
+	}
+	if allowed == nil {
+		return Decision{}
+	}
+	return Decision{Allowed: true, Rule: allowed.ID}
+}
+
+func (r *PolicyRule) matches(in PolicyInput, env map[string]any) bool {
+	if !matchesAny(r.Actions, in.Action) {
+		return false
+	}
+	if len(r.Resources) > 0 && !matchesAny(r.Resources, in.Resource.Type) {
+		return false
+	}
+	if len(r.Roles) > 0 {
+		if in.Principal == nil {
+			return false
+		}
+		granted := false
+		for _, role := range r.Roles {
+			granted = granted || in.Principal.HasRole(role)
+		}
+		if !granted {
+			return false
+		}
+	}
+	for _, c := range r.conditions {
+		if !c.eval(env) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ScopeMatches(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyEnv builds the attribute tree conditions are evaluated against
+func policyEnv(in PolicyInput, now time.Time) map[string]any {
+	principal := map[string]any{}
+	if p := in.Principal; p != nil {
+		attrs := make(map[string]any, len(p.Attributes))
+		for k, v := range p.Attributes {
+			attrs[k] = v
+		}
+		principal = map[string]any{
+			"login":      p.Login,
+			"roles":      stringList(p.Roles),
+			"scopes":     stringList(p.Scopes),
+			"attributes": attrs,
+		}
+	}
+
+	resource := map[string]any{"type": in.Resource.Type, "id": in.Resource.ID, "attributes": map[string]any{}}
+	if in.Resource.Attributes != nil {
+		resource["attributes"] = in.Resource.Attributes
+	}
+
+	// the time is the server's, callers can't move it to pass time windows
+	request := make(map[string]any, len(in.Request)+3)
+	for k, v := range in.Request {
+		request[k] = v
+	}
+	request["time"] = now.Format(time.RFC3339)
+	request["hour"] = now.Hour()
+	request["weekday"] = int(now.Weekday())
+
+	return map[string]any{"principal": principal, "resource": resource, "request": request, "action": in.Action}
+}
+
+func stringList(s []string) []any {
+	list := make([]any, len(s))
+	for i, v := range s {
+		list[i] = v
+	}
+	return list
+}
+
+// condition is a compiled `<operand> <operator> <operand>` expression
+type condition struct {
+	left, right operand
+	op          string
+}
+
+// operand is either an attribute path or a literal
+type operand struct {
+	path    []string
+	literal any
+}
+
+func (o operand) value(env map[string]any) any {
+	if o.path == nil {
+		return o.literal
+	}
+	var v any = env
+	for _, name := range o.path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		if v, ok = m[name]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+var conditionOperators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true, "in": true, "contains": true}
+
+func parseCondition(expr string) (condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return condition{}, fmt.Errorf("condition %q: %w", expr, err)
+	}
+	if len(tokens) != 3 || !conditionOperators[tokens[1]] {
+		return condition{}, fmt.Errorf("condition %q: expected <operand> <operator> <operand>", expr)
+	}
+	left, err := parseOperand(tokens[0])
+	if err != nil {
+		return condition{}, fmt.Errorf("condition %q: %w", expr, err)
+	}
+	right, err := parseOperand(tokens[2])
+	if err != nil {
+		return condition{}, fmt.Errorf("condition %q: %w", expr, err)
+	}
+	return condition{left: left, op: tokens[1], right: right}, nil
+}
+
+// tokenizeCondition splits an expression by spaces, keeping quoted strings and lists whole
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(expr[i+1:], c)
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+		case c == '[':
+			end := strings.IndexByte(expr[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated list")
+			}
+			tokens = append(tokens, expr[i:i+end+1])
+			i += end + 1
+		default:
+			end := strings.IndexAny(expr[i:], " \t")
+			if end < 0 {
+				end = len(expr) - i
+			}
+			tokens = append(tokens, expr[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+func parseOperand(token string) (operand, error) {
+	if strings.HasPrefix(token, "[") {
+		list := []any{}
+		for _, item := range strings.Split(strings.Trim(token, "[]"), ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, ok := parseLiteral(item)
+			if !ok {
+				return operand{}, fmt.Errorf("list item %q is not a literal", item)
+			}
+			list = append(list, v)
+		}
+		return operand{literal: list}, nil
+	}
+	if v, ok := parseLiteral(token); ok {
+		return operand{literal: v}, nil
+	}
+	path := strings.Split(token, ".")
+	switch path[0] {
+	case "principal", "resource", "request", "action":
+		return operand{path: path}, nil
+	}
+	return operand{}, fmt.Errorf("unknown attribute %q", token)
+}
+
+func parseLiteral(token string) (any, bool) {
+	if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0] {
+		return token[1 : len(token)-1], true
+	}
+	if token == "true" || token == "false" {
+		return token == "true", true
+	}
+	if f, err := strconv.ParseFloat(token, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+func (c condition) eval(env map[string]any) bool {
+	a, b := c.left.value(env), c.right.value(env)
+	if a == nil || b == nil {
+		return false
+	}
+	switch c.op {
+	case "==":
+		return equalValues(a, b)
+	case "!=":
+		return !equalValues(a, b)
+	case "in":
+		return listContains(b, a)
+	case "contains":
+		return listContains(a, b)
+	}
+
+	cmp, ok := compareValues(a, b)
+	if !ok {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// toNumber converts numbers of any kind, as decoded from YAML or JSON, to float64
+func toNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func equalValues(a, b any) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch a.(type) {
+	case string, bool:
+		return a == b
+	}
+	return false
+}
+
+func listContains(list, v any) bool {
+	items, ok := list.([]any)
+	if !ok {
+		return false
+	}
+	for _, item := range items {
+		if equalValues(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two numbers or two strings, e.g. RFC 3339 times
+func compareValues(a, b any) (int, bool) {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	x, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+	y, ok := b.(string)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+// PolicyEngine makes decisions by a policy file, reloaded when the file changes
+type PolicyEngine struct {
+	// Now returns the time of a decision, request.hour and request.weekday are taken from it
+	Now func() time.Time
+
+	path    string
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+}
+
+// NewPolicyEngine - loads a policy file in YAML or JSON
+func NewPolicyEngine(path string) (*PolicyEngine, error) {
+	e := &PolicyEngine{path: path, Now: time.Now}
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload - loads the policy file again if it was modified since the last load,
+// a broken file leaves the current policy in place
+func (e *PolicyEngine) Reload() (bool, error) {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return false, err
+	}
+
+	e.mu.RLock()
+	unchanged := e.policy != nil && info.ModTime().Equal(e.modTime)
+	e.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return false, err
+	}
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", e.path, err)
+	}
+
+	e.mu.Lock()
+	e.policy, e.modTime = p, info.ModTime()
+	e.mu.Unlock()
+	return true, nil
+}
+
+// Watch - checks the policy file for changes every interval until the context is done
+func (e *PolicyEngine) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := e.Reload()
+			if err != nil {
+				log.Printf("[WARN] failed to reload policy, keeping the previous one, %v", err)
+				continue
+			}
+			if reloaded {
+				log.Printf("[INFO] policy reloaded from %s", e.path)
+			}
+		}
+	}
+}
+
+// Decide - evaluates the current policy
+func (e *PolicyEngine) Decide(in PolicyInput) Decision {
+	e.mu.RLock()
+	p := e.policy
+	e.mu.RUnlock()
+	return p.Decide(in, e.Now())
+}
+
+// Authorize - decides on an action of the principal of a context on a resource,
+// request attributes are taken from the context as put by the Auth middleware.
+// Returns an error with ErrAccessDenied if the action isn't allowed
+func (e *PolicyEngine) Authorize(ctx context.Context, action string, resource Resource) error {
+	p, _ := PrincipalFromContext(ctx)
+	request, _ := ctx.Value(requestAttributesKey{}).(map[string]any)
+	d := e.Decide(PolicyInput{Principal: p, Action: action, Resource: resource, Request: request})
+	if !d.Allowed {
+		return fmt.Errorf("%s: %s on %s", ErrAccessDenied, action, resource.Type)
+	}
+	return nil
+}
+
+// Authorize - decides on an action on a resource with the configured policy engine
+func (s *AuthService) Authorize(ctx context.Context, action string, resource Resource) error {
+	if s.Policy == nil {
+		return errors.New(ErrPolicyNotConfigured)
+	}
+	return s.Policy.Authorize(ctx, action, resource)
+}
+
+type requestAttributesKey struct{}
+
+// WithRequestAttributes - returns a copy of a request carrying its method, path
+// and client ip for policy conditions
+func WithRequestAttributes(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestAttributesKey{}, requestAttributes(r)))
+}
+
+func requestAttributes(r *http.Request) map[string]any {
+	return map[string]any{"method": r.Method, "path": r.URL.Path, "ip": clientIP(r)}
+}
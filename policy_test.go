@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// monday10am is within business hours of the example policy
+var monday10am = time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+func newTestPolicyEngine(t *testing.T, src string) *PolicyEngine {
+	data, err := os.ReadFile(src)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), filepath.Base(src))
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+	e, err := NewPolicyEngine(path)
+	assert.NoError(t, err)
+	e.Now = func() time.Time { return monday10am }
+	return e
+}
+
+func TestPolicyDecide(t *testing.T) {
+	e := newTestPolicyEngine(t, "policy.example.yaml")
+
+	editor := &Principal{Login: "user1", Roles: []string{"editor"}, Attributes: map[string]string{"org": "acme"}}
+	doc := func(org string, archived bool) Resource {
+		return Resource{Type: "document", ID: "1", Attributes: map[string]any{"org": org, "archived": archived}}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		in       PolicyInput
+		now      time.Time
+		decision Decision
+	}{
+		{"read by anyone", PolicyInput{Action: "documents:read", Resource: doc("other", false)}, monday10am,
+			Decision{Allowed: true, Rule: "read-documents"}},
+		{"edit own org", PolicyInput{Principal: editor, Action: "documents:edit", Resource: doc("acme", false)}, monday10am,
+			Decision{Allowed: true, Rule: "edit-own-org-documents"}},
+		{"edit other org", PolicyInput{Principal: editor, Action: "documents:edit", Resource: doc("other", false)}, monday10am,
+			Decision{}},
+		{"edit after hours", PolicyInput{Principal: editor, Action: "documents:edit", Resource: doc("acme", false)}, monday10am.Add(9 * time.Hour),
+			Decision{}},
+		{"edit on weekend", PolicyInput{Principal: editor, Action: "documents:edit", Resource: doc("acme", false)}, monday10am.AddDate(0, 0, -1),
+			Decision{}},
+		{"edit without role", PolicyInput{Principal: &Principal{Login: "user2", Attributes: editor.Attributes}, Action: "documents:edit", Resource: doc("acme", false)}, monday10am,
+			Decision{}},
+		{"edit without org", PolicyInput{Principal: &Principal{Login: "user2", Roles: editor.Roles}, Action: "documents:edit", Resource: doc("acme", false)}, monday10am,
+			Decision{}},
+		{"deny overrides allow", PolicyInput{Principal: editor, Action: "documents:edit", Resource: doc("acme", true)}, monday10am,
+			Decision{Allowed: false, Rule: "archived-are-read-only"}},
+		{"admin", PolicyInput{Principal: &Principal{Login: "root", Roles: []string{"admin"}}, Action: "users:delete", Resource: Resource{Type: "user"}}, monday10am,
+			Decision{Allowed: true, Rule: "admins"}},
+		{"nothing by default", PolicyInput{Principal: editor, Action: "users:delete", Resource: Resource{Type: "user"}}, monday10am,
+			Decision{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := tt.now
+			e.Now = func() time.Time { return now }
+			assert.Equal(t, tt.decision, e.Decide(tt.in))
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	// json is accepted as well
+	p, err := ParsePolicy([]byte(`{"rules": [{"effect": "allow", "actions": ["documents:*"],
+		"when": ["request.method == 'GET'", "principal.roles contains 'viewer'", "request.ip != \"10.0.0.1\""]}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "rule-1", p.Rules[0].ID)
+	viewer := &Principal{Login: "user1", Roles: []string{"viewer"}}
+	in := PolicyInput{Principal: viewer, Action: "documents:read", Request: map[string]any{"method": "GET", "ip": "127.0.0.1"}}
+	assert.True(t, p.Decide(in, time.Now()).Allowed)
+	in.Request["ip"] = "10.0.0.1"
+	assert.False(t, p.Decide(in, time.Now()).Allowed)
+	// a missing attribute makes even != false
+	delete(in.Request, "ip")
+	assert.False(t, p.Decide(in, time.Now()).Allowed)
+
+	// time attributes are the server's, whatever the caller claims
+	p, err = ParsePolicy([]byte(`rules: [{effect: allow, actions: [a], when: ["request.hour >= 9", "request.hour < 18"]}]`))
+	assert.NoError(t, err)
+	in = PolicyInput{Action: "a", Request: map[string]any{"hour": 10, "weekday": 1, "time": monday10am.Format(time.RFC3339)}}
+	assert.False(t, p.Decide(in, monday10am.Add(9*time.Hour)).Allowed)
+	assert.True(t, p.Decide(in, monday10am).Allowed)
+
+	for _, src := range []string{
+		`rules: [{effect: permit, actions: [a]}]`,
+		`rules: [{effect: allow}]`,
+		`rules: [{effect: allow, actions: [a], when: ["request.hour >="]}]`,
+		`rules: [{effect: allow, actions: [a], when: ["user.org == 'acme'"]}]`,
+		`rules: [{effect: allow, actions: [a], when: ["request.method == 'GET"]}]`,
+		`rules: [{effect: allow, actions: [a], when: ["request.hour ~ 1"]}]`,
+	} {
+		_, err := ParsePolicy([]byte(src))
+		assert.Error(t, err, src)
+	}
+}
+
+func TestPolicyEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("rules: [{effect: allow, actions: [a]}]"), 0o600))
+	e, err := NewPolicyEngine(path)
+	assert.NoError(t, err)
+	assert.True(t, e.Decide(PolicyInput{Action: "a"}).Allowed)
+
+	reloaded, err := e.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+
+	assert.NoError(t, os.WriteFile(path, []byte("rules: [{effect: allow, actions: [b]}]"), 0o600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	reloaded, err = e.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.False(t, e.Decide(PolicyInput{Action: "a"}).Allowed)
+	assert.True(t, e.Decide(PolicyInput{Action: "b"}).Allowed)
+
+	// a broken file keeps the previous policy
+	assert.NoError(t, os.WriteFile(path, []byte("rules: [{effect: maybe, actions: [c]}]"), 0o600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	_, err = e.Reload()
+	assert.Error(t, err)
+	assert.True(t, e.Decide(PolicyInput{Action: "b"}).Allowed)
+
+	// the watcher picks changes up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, 10*time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("rules: [{effect: allow, actions: [d]}]"), 0o600))
+	assert.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(3*time.Second)))
+	assert.Eventually(t, func() bool { return e.Decide(PolicyInput{Action: "d"}).Allowed }, time.Second, 10*time.Millisecond)
+}
+
+func TestAuthorize(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	up := NewUsers()
+	service := NewAuthService(tp, up)
+
+	err := service.Authorize(context.Background(), "documents:read", Resource{Type: "document"})
+	assert.EqualError(t, err, ErrPolicyNotConfigured)
+
+	service = NewAuthService(tp, up, Policies(newTestPolicyEngine(t, "policy.example.yaml")))
+	_, err = service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	assert.NoError(t, service.GrantRole("user1", "editor"))
+	user, err := up.Get("user1")
+	assert.NoError(t, err)
+	user.Attributes = map[string]string{"org": "acme"}
+	assert.NoError(t, up.Update(*user))
+	token, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+
+	// the principal and request attributes are put by the Auth middleware
+	var allowed, denied error
+	handler := service.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed = service.Authorize(r.Context(), "documents:edit", Resource{Type: "document", Attributes: map[string]any{"org": "acme"}})
+		denied = service.Authorize(r.Context(), "documents:edit", Resource{Type: "document", Attributes: map[string]any{"org": "other"}})
+	}))
+	req, _ := http.NewRequest("PUT", "/documents/1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, allowed)
+	assert.EqualError(t, denied, ErrAccessDenied+": documents:edit on document")
+
+	// decision endpoint
+	authorize := func(token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/authorize", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		service.Handlers("/auth").ServeHTTP(response, req)
+		return response
+	}
+
+	response := authorize(token, `{"action": "documents:edit", "resource": {"type": "document", "attributes": {"org": "acme"}}}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var decision Decision
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&decision))
+	assert.Equal(t, Decision{Allowed: true, Rule: "edit-own-org-documents"}, decision)
+
+	response = authorize(token, `{"action": "documents:edit", "resource": {"type": "document", "attributes": {"org": "acme", "archived": true}}}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"allowed": false, "rule": "archived-are-read-only"}`, response.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, authorize(token, `{"resource": {"type": "document"}}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, authorize("", `{"action": "documents:read"}`).Code)
+
+	service.Policy = nil
+	assert.Equal(t, http.StatusNotImplemented, authorize(token, `{"action": "documents:read"}`).Code)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Principal is the authenticated caller, the Auth middleware puts it into the request context
+type Principal struct {
+	Login     string
+	Token     *Token
+	ExpiresAt time.Time
+	Roles     []string
+	Scopes    []string
+	// Attributes are attributes of the user for policy conditions
+	Attributes map[string]string
+	// Downscoped is set for tokens minted by Downscope, see RequireSession
+	Downscoped bool
+}
+
+type principalKey struct{}
+
+// ContextWithPrincipal - returns a copy of a context carrying a principal
+func ContextWithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext - returns the principal of a context, put by the Auth middleware
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// WithPrincipal - returns a copy of a request with a principal in its context,
+// lets handlers behind the Auth middleware be unit tested without tokens
+func WithPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(ContextWithPrincipal(r.Context(), p))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthPutsPrincipal(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	authService := NewAuthService(tp, NewUsers())
+	_, err := authService.Signup("user1", "password1")
+	assert.NoError(t, err)
+	session, err := authService.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	var got *Principal
+	handler := authService.Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		assert.True(t, ok)
+		got = p
+	}))
+
+	req, _ := http.NewRequest("GET", "/membersonly", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Access.Token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.NotNil(t, got)
+	assert.Equal(t, "user1", got.Login)
+	assert.Equal(t, session.Access.ID, got.Token.ID)
+	assert.WithinDuration(t, session.Access.ExpiresAt, got.ExpiresAt, time.Second)
+}
+
+func TestPrincipalFromContext(t *testing.T) {
+	p, ok := PrincipalFromContext(context.Background())
+	assert.False(t, ok)
+	assert.Nil(t, p)
+
+	ctx := ContextWithPrincipal(context.Background(), &Principal{Login: "user1"})
+	p, ok = PrincipalFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "user1", p.Login)
+}
+
+func TestMembersOnly(t *testing.T) {
+	// the handler is tested without the middleware and tokens
+	req, _ := http.NewRequest("GET", "/membersonly", nil)
+	response := httptest.NewRecorder()
+	membersOnly(response, WithPrincipal(req, &Principal{Login: "user1"}))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "Members only area, congrats, user1!", response.Body.String())
+
+	response = httptest.NewRecorder()
+	membersOnly(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
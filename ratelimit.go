@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket of Requests tokens refilled evenly over Per,
+// so bursts of up to Requests are allowed. A zero limit doesn't limit anything
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// EndpointLimits are the limits of an endpoint per client IP and per login,
+// the login is taken from the {"login": ...} body
+type EndpointLimits struct {
+	IP    RateLimit
+	Login RateLimit
+}
+
+// DefaultRateLimits - returns limits by endpoint path after the prefix of Handlers,
+// the "*" entry is shared by endpoints without their own limits. Endpoints hashing
+// passwords or sending mail get tighter ones
+func DefaultRateLimits() map[string]EndpointLimits {
+	perMinute := func(n int) RateLimit { return RateLimit{Requests: n, Per: time.Minute} }
+	return map[string]EndpointLimits{
+		"*":                    {IP: perMinute(120)},
+		"/signin":              {IP: perMinute(20), Login: perMinute(10)},
+		"/signup":              {IP: perMinute(10)},
+		"/mfa/verify":          {IP: perMinute(20)},
+		"/magic-link":          {IP: perMinute(10), Login: perMinute(3)},
+		"/verify-email/resend": {IP: perMinute(10), Login: perMinute(3)},
+		"/password/forgot":     {IP: perMinute(10), Login: perMinute(3)},
+		"/password/reset":      {IP: perMinute(10)},
+		"/password/change":     {IP: perMinute(10)},
+	}
+}
+
+// RateLimiter keeps token buckets in memory
+type RateLimiter struct {
+	// Limits are limits by endpoint path after the prefix of Handlers, see DefaultRateLimits
+	Limits map[string]EndpointLimits
+	// Now returns the current time
+	Now func() time.Time
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is the time the bucket is refilled completely at, it can be dropped then
+	full time.Time
+}
+
+func NewRateLimiter(limits map[string]EndpointLimits) *RateLimiter {
+	return &RateLimiter{Limits: limits, Now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// RateLimitResult is the state of a bucket after taking a token from it
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     RateLimit
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, if not allowed
+	RetryAfter time.Duration
+}
+
+// Take() takes a token from the bucket of a key, if there is one
+func (rl *RateLimiter) Take(key string, limit RateLimit) RateLimitResult {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.Now()
+	rl.cleanup(now)
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Per.Seconds()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	res := RateLimitResult{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(res.Reset)
+	return res
+}
+
+// cleanup drops full buckets once a minute, must be called with the lock held
+func (rl *RateLimiter) cleanup(now time.Time) {
+	if now.Sub(rl.lastCleanup) < time.Minute {
+		return
+	}
+	rl.lastCleanup = now
+	for key, b := range rl.buckets {
+		if !now.Before(b.full) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// limitsOf returns the limits of an endpoint and the name of its buckets
+func (rl *RateLimiter) limitsOf(endpoint string) (EndpointLimits, string) {
+	if limits, ok := rl.Limits[endpoint]; ok {
+		return limits, endpoint
+	}
+	return rl.Limits["*"], "*"
+}
+
+// ParseTrustedProxies - parses a comma separated list of proxy addresses and CIDRs,
+// e.g. "10.0.0.0/8, 192.168.1.1"
+func ParseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// TrustedProxies sets proxies trusted to report client IPs in `X-Forwarded-For`
+func TrustedProxies(proxies ...netip.Prefix) AuthServiceOption {
+	return func(s *AuthService) {
+		s.TrustedProxies = proxies
+	}
+}
+
+// RateLimits sets the rate limiter of the handlers, nil disables rate limiting
+func RateLimits(rl *RateLimiter) AuthServiceOption {
+	return func(s *AuthService) {
+		s.RateLimiter = rl
+	}
+}
+
+func (s *AuthService) trusted(addr netip.Addr) bool {
+	for _, p := range s.TrustedProxies {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP - returns the IP address of the client of a request. Requests of
+// trusted proxies are attributed to the last address in `X-Forwarded-For`
+// not of a trusted proxy, as earlier ones may be forged by the client
+func (s *AuthService) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !s.trusted(addr) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	client := addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop
+		if !s.trusted(hop) {
+			break
+		}
+	}
+	return client.Unmap().String()
+}
+
+type clientIPKey struct{}
+
+// withClientIP returns a copy of a request carrying its client IP for clientIP
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the client IP resolved by the handlers of AuthService,
+// or the remote address of a request not passed through them
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// maxLoginBody limits bodies read to find the login of a request
+const maxLoginBody = 64 << 10
+
+// requestLogin returns the login of a {"login": ...} body, the body is kept for the handler
+func requestLogin(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxLoginBody))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), r.Body))
+	if err != nil {
+		return ""
+	}
+	var req struct {
+		Login string `json:"login"`
+	}
+	if json.Unmarshal(data, &req) != nil {
+		return ""
+	}
+	return req.Login
+}
+
+// rateLimit - middleware resolving client IPs and limiting requests to endpoints
+// under a prefix, responds 429 with `Retry-After` once a limit is exceeded.
+// Sets `RateLimit-*` headers of the most exhausted limit of a request
+func (s *AuthService) rateLimit(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.ClientIP(r)
+		r = withClientIP(r, ip)
+		if s.RateLimiter == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		limits, endpoint := s.RateLimiter.limitsOf(strings.TrimPrefix(r.URL.Path, prefix))
+		var worst *RateLimitResult
+		take := func(key string, limit RateLimit) {
+			if !limit.enabled() || (worst != nil && !worst.Allowed) {
+				return
+			}
+			res := s.RateLimiter.Take(endpoint+" "+key, limit)
+			if worst == nil || !res.Allowed || res.Remaining < worst.Remaining {
+				worst = &res
+			}
+		}
+		take("ip:"+ip, limits.IP)
+		if limits.Login.enabled() {
+			if login := requestLogin(r); login != "" {
+				take("login:"+login, limits.Login)
+			}
+		}
+		if worst == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		writeRateLimitHeaders(w, *worst)
+		if !worst.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(worst.RetryAfter))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{"status": "RATE_LIMITED"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeRateLimitHeaders sets headers of draft-ietf-httpapi-ratelimit-headers
+func writeRateLimitHeaders(w http.ResponseWriter, res RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit.Requests))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", res.Limit.Requests, ceilSeconds(res.Limit.Per)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
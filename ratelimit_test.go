@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	rl := NewRateLimiter(nil)
+	rl.Now = func() time.Time { return now }
+	limit := RateLimit{Requests: 3, Per: 3 * time.Second}
+
+	// a burst of the whole bucket is allowed
+	for i := 2; i >= 0; i-- {
+		res := rl.Take("key1", limit)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res := rl.Take("key1", limit)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+	assert.True(t, rl.Take("key2", limit).Allowed)
+
+	// tokens are refilled evenly
+	now = now.Add(time.Second)
+	assert.True(t, rl.Take("key1", limit).Allowed)
+	assert.False(t, rl.Take("key1", limit).Allowed)
+	now = now.Add(time.Hour)
+	res = rl.Take("key1", limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 2, res.Remaining)
+
+	// full buckets are dropped
+	now = now.Add(time.Hour)
+	rl.Take("key3", limit)
+	assert.Len(t, rl.buckets, 1)
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	assert.NoError(t, err)
+	service := NewAuthService(NewJwtProvider(Key("my_secret_key")), NewUsers(), TrustedProxies(proxies...))
+
+	ip := func(remote string, forwarded ...string) string {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		for _, f := range forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		return service.ClientIP(req)
+	}
+
+	assert.Equal(t, "203.0.113.1", ip("203.0.113.1:1234"))
+	// untrusted peers can't forge their address
+	assert.Equal(t, "203.0.113.1", ip("203.0.113.1:1234", "198.51.100.1"))
+	assert.Equal(t, "198.51.100.1", ip("10.0.0.1:1234", "198.51.100.1"))
+	// the client prepends a forged address, the proxies append the real one
+	assert.Equal(t, "198.51.100.1", ip("10.0.0.1:1234", "1.2.3.4, 198.51.100.1, 192.168.1.1"))
+	assert.Equal(t, "198.51.100.1", ip("10.0.0.1:1234", "1.2.3.4", "198.51.100.1, 10.1.2.3"))
+	assert.Equal(t, "10.0.0.2", ip("10.0.0.1:1234", "garbage, 10.0.0.2"))
+	assert.Equal(t, "10.0.0.1", ip("10.0.0.1:1234"))
+	assert.Equal(t, "198.51.100.1", ip("[::ffff:10.0.0.1]:1234", "198.51.100.1"))
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies("proxy")
+	assert.Error(t, err)
+	proxies, err = ParseTrustedProxies("")
+	assert.NoError(t, err)
+	assert.Empty(t, proxies)
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, mustProxies(t, "10.1.2.3/8"))
+}
+
+func mustProxies(t *testing.T, list string) []netip.Prefix {
+	proxies, err := ParseTrustedProxies(list)
+	assert.NoError(t, err)
+	return proxies
+}
+
+func TestHandleRateLimit(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	rl := NewRateLimiter(map[string]EndpointLimits{
+		"*":       {IP: RateLimit{Requests: 5, Per: time.Minute}},
+		"/signin": {IP: RateLimit{Requests: 4, Per: time.Minute}, Login: RateLimit{Requests: 2, Per: time.Minute}},
+	})
+	service := NewAuthService(tp, NewUsers(), RateLimits(rl), TrustedProxies(mustProxies(t, "10.0.0.1")...),
+		Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	do := func(path, forwarded, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+	signin := `{"login": "user1", "password": "password1"}`
+
+	// the login limit is tighter, the body still reaches the handler
+	response := do("/auth/signin", "198.51.100.1", signin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "2", response.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", response.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", response.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", response.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, http.StatusOK, do("/auth/signin", "198.51.100.2", signin).Code)
+	response = do("/auth/signin", "198.51.100.3", signin)
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+	assert.Equal(t, "30", response.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"status": "RATE_LIMITED"}`, response.Body.String())
+
+	// other logins of the IP have their own buckets
+	response = do("/auth/signin", "198.51.100.1", `{"login": "user2", "password": "password1"}`)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Equal(t, "2", response.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", response.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/signin", "198.51.100.1", `{"login": "user3"}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/signin", "198.51.100.1", `{"login": "user4"}`).Code)
+	assert.Equal(t, http.StatusTooManyRequests, do("/auth/signin", "198.51.100.1", `{"login": "user5"}`).Code)
+
+	// endpoints without limits of their own share the "*" buckets
+	for i := 0; i < 5; i++ {
+		path := "/auth/refresh"
+		if i%2 == 1 {
+			path = "/auth/logout"
+		}
+		assert.NotEqual(t, http.StatusTooManyRequests, do(path, "198.51.100.1", `{}`).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, do("/auth/refresh", "198.51.100.1", `{}`).Code)
+	assert.NotEqual(t, http.StatusTooManyRequests, do("/auth/refresh", "198.51.100.2", `{}`).Code)
+
+	// nil disables rate limiting
+	service.RateLimiter = nil
+	response = do("/auth/signin", "198.51.100.3", signin)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Header().Get("RateLimit-Limit"))
+}
+
+func TestRequestLogin(t *testing.T) {
+	body := `{"login": "user1", "password": "password1"}`
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+	assert.Equal(t, "user1", requestLogin(req))
+	data, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(data))
+
+	req, _ = http.NewRequest("POST", "/", bytes.NewBufferString("not json"))
+	assert.Empty(t, requestLogin(req))
+	req, _ = http.NewRequest("GET", "/", nil)
+	assert.Empty(t, requestLogin(req))
+}
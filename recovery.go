@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"slices"
+	"strings"
+)
+
+const ErrRecoveryCodeInvalid = "invalid recovery code"
+
+const (
+	recoveryCodeCount = 10
+	// recoveryCodeAlphabet leaves out characters easy to confuse, like 0 and o
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// newRecoveryCode returns a random code formatted as `xxxxx-xxxxx`
+func newRecoveryCode() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(recoveryCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// normalizeRecoveryCode makes codes typed with other case or separators match
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+// newRecoveryCodes generates a set of codes, returns the codes to show the user
+// once and their hashes to store
+func (s *AuthService) newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		hash, err := s.Hasher.Hash(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// RegenerateRecoveryCodes - replaces recovery codes of a user with mfa enabled,
+// the old codes stop working
+func (s *AuthService) RegenerateRecoveryCodes(login string) ([]string, error) {
+	codes, hashes, err := s.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Users.Modify(login, func(u *User) error {
+		if !u.TOTPConfirmed {
+			return errors.New(ErrTOTPNotEnrolled)
+		}
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// useRecoveryCode checks a recovery code and removes it, so it works once.
+// Hashes are verified before the user is locked, it's locked only to remove the matched one
+func (s *AuthService) useRecoveryCode(user *User, code string) error {
+	code = normalizeRecoveryCode(code)
+	matched := ""
+	for _, hash := range user.RecoveryCodes {
+		if ok, _ := s.Hasher.Verify(hash, code); ok {
+			matched = hash
+			break
+		}
+	}
+	if matched == "" {
+		return errors.New(ErrRecoveryCodeInvalid)
+	}
+
+	// a concurrent request may have used the code since the user was read
+	return s.Users.Modify(user.Login, func(u *User) error {
+		i := slices.Index(u.RecoveryCodes, matched)
+		if i < 0 {
+			return errors.New(ErrRecoveryCodeInvalid)
+		}
+		u.RecoveryCodes = slices.Delete(u.RecoveryCodes, i, i+1)
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newMFAService returns a service with user1 enrolled into TOTP and its recovery codes
+func newMFAService(t *testing.T) (*AuthService, []string) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	// cheap hashes, recovery codes are hashed one by one
+	service := NewAuthService(tp, NewUsers(), Argon2(Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1, SaltLen: 16, KeyLen: 32}))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	enrollment, err := service.EnrollTOTP("user1")
+	assert.NoError(t, err)
+	codes, err := service.ConfirmTOTP("user1", currentTOTP(t, enrollment.Secret, 0))
+	assert.NoError(t, err)
+	return service, codes
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	service, codes := newMFAService(t)
+	assert.Len(t, codes, 10)
+	for _, code := range codes {
+		assert.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, code)
+	}
+
+	// stored hashed with the password hasher
+	user, err := service.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.Len(t, user.RecoveryCodes, 10)
+	for i, hash := range user.RecoveryCodes {
+		assert.NotContains(t, hash, normalizeRecoveryCode(codes[i]))
+		assert.True(t, service.Hasher.Recognizes(hash))
+	}
+
+	signin := func() string {
+		session, err := service.SigninSession("user1", "password1")
+		assert.NoError(t, err)
+		assert.NotNil(t, session.MFA)
+		return session.MFA.Token
+	}
+
+	// a code works once, regardless of case and separators
+	session, err := service.VerifyMFA(signin(), " "+strings.ToUpper(strings.Replace(codes[3], "-", "", 1))+" ")
+	assert.NoError(t, err)
+	assert.NotNil(t, session.Access)
+	_, err = service.VerifyMFA(signin(), codes[3])
+	assert.EqualError(t, err, ErrRecoveryCodeInvalid)
+	user, err = service.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.Len(t, user.RecoveryCodes, 9)
+
+	_, err = service.VerifyMFA(signin(), "aaaaa-aaaaa")
+	assert.EqualError(t, err, ErrRecoveryCodeInvalid)
+
+	// regeneration invalidates the old codes
+	fresh, err := service.RegenerateRecoveryCodes("user1")
+	assert.NoError(t, err)
+	assert.Len(t, fresh, 10)
+	_, err = service.VerifyMFA(signin(), codes[4])
+	assert.EqualError(t, err, ErrRecoveryCodeInvalid)
+	_, err = service.VerifyMFA(signin(), fresh[0])
+	assert.NoError(t, err)
+
+	// no codes without mfa
+	assert.NoError(t, service.DisableTOTP("user1"))
+	user, err = service.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.Empty(t, user.RecoveryCodes)
+	_, err = service.RegenerateRecoveryCodes("user1")
+	assert.EqualError(t, err, ErrTOTPNotEnrolled)
+}
+
+// probeHasher calls probe on every verification
+type probeHasher struct {
+	PasswordHasher
+	probe func()
+}
+
+func (p probeHasher) Verify(hash, password string) (bool, error) {
+	p.probe()
+	return p.PasswordHasher.Verify(hash, password)
+}
+
+func TestRecoveryCodesVerifiedUnlocked(t *testing.T) {
+	service, codes := newMFAService(t)
+	users := service.Users.(*Users)
+	verified := 0
+	service.Hasher = probeHasher{PasswordHasher: service.Hasher, probe: func() {
+		verified++
+		// changes of users aren't blocked by slow hashes
+		assert.True(t, users.mu.TryLock())
+		users.mu.Unlock()
+	}}
+
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	_, err = service.VerifyMFA(session.MFA.Token, "aaaaa-aaaaa")
+	assert.EqualError(t, err, ErrRecoveryCodeInvalid)
+	_, err = service.VerifyMFA(session.MFA.Token, codes[9])
+	assert.NoError(t, err)
+	assert.Greater(t, verified, 10)
+}
+
+func TestHandleRecoveryCodes(t *testing.T) {
+	service, codes := newMFAService(t)
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	full, err := service.VerifyMFA(session.MFA.Token, codes[0])
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	req, _ := http.NewRequest("POST", "/auth/mfa/recovery-codes", nil)
+	req.Header.Set("Authorization", "Bearer "+full.Access.Token)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var result struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&result))
+	assert.Len(t, result.RecoveryCodes, 10)
+
+	// the new code completes signin through the endpoint
+	session, err = service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	body, _ := json.Marshal(map[string]string{"mfa_token": session.MFA.Token, "code": result.RecoveryCodes[0]})
+	req, _ = http.NewRequest("POST", "/auth/mfa/verify", bytes.NewBuffer(body))
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("POST", "/auth/mfa/recovery-codes", nil)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	ErrRefreshTokenInvalid = "invalid refresh token"
+	ErrRefreshTokenReused  = "refresh token reuse detected"
+)
+
+type RefreshProvider interface {
+	// Issue() creates a refresh token for a given login, starting a new token family
+	Issue(login string) (*Token, error)
+	// Rotate() exchanges a refresh token for a new one of the same family,
+	// the exchanged token can't be used again
+	Rotate(token string) (*Token, error)
+	// Revoke() revokes a refresh token with its whole family
+	Revoke(token string) error
+	// RevokeLogin() revokes all refresh tokens of a given login
+	RevokeLogin(login string) error
+}
+
+// MemoryRefreshTokens keeps opaque refresh tokens in memory, tokens are stored
+// hashed and grouped in families, one family per signin. Presenting an already
+// rotated token revokes the whole family, as it means the token was stolen
+type MemoryRefreshTokens struct {
+	ExpirationTime time.Duration
+
+	mu       sync.Mutex
+	tokens   map[string]*refreshToken // by token hash
+	families map[string]*refreshFamily
+}
+
+type refreshToken struct {
+	family    string
+	expiresAt time.Time
+	used      bool
+}
+
+type refreshFamily struct {
+	login     string
+	expiresAt time.Time
+	revoked   bool
+}
+
+func NewMemoryRefreshTokens(exp time.Duration) *MemoryRefreshTokens {
+	return &MemoryRefreshTokens{
+		ExpirationTime: exp,
+		tokens:         make(map[string]*refreshToken),
+		families:       make(map[string]*refreshFamily),
+	}
+}
+
+// Issue() creates a refresh token for a given login, starting a new token family
+func (m *MemoryRefreshTokens) Issue(login string) (*Token, error) {
+	family, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanup()
+	m.families[family] = &refreshFamily{login: login}
+	return m.issue(family)
+}
+
+// Rotate() exchanges a refresh token for a new one of the same family
+func (m *MemoryRefreshTokens) Rotate(token string) (*Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rt, ok := m.tokens[hashToken(token)]
+	if !ok || time.Now().After(rt.expiresAt) {
+		return nil, errors.New(ErrRefreshTokenInvalid)
+	}
+	family := m.families[rt.family]
+	if family.revoked {
+		return nil, errors.New(ErrRefreshTokenInvalid)
+	}
+	if rt.used {
+		family.revoked = true
+		return nil, errors.New(ErrRefreshTokenReused)
+	}
+
+	rt.used = true
+	return m.issue(rt.family)
+}
+
+// Revoke() revokes a refresh token with its whole family, unknown tokens are ignored
+func (m *MemoryRefreshTokens) Revoke(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rt, ok := m.tokens[hashToken(token)]; ok {
+		m.families[rt.family].revoked = true
+	}
+	return nil
+}
+
+// RevokeLogin() revokes all refresh token families of a given login
+func (m *MemoryRefreshTokens) RevokeLogin(login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, family := range m.families {
+		if family.login == login {
+			family.revoked = true
+		}
+	}
+	return nil
+}
+
+// issue creates a token in a given family, must be called with the lock held
+func (m *MemoryRefreshTokens) issue(family string) (*Token, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(m.ExpirationTime)
+	m.tokens[hashToken(token)] = &refreshToken{family: family, expiresAt: expiresAt}
+	m.families[family].expiresAt = expiresAt
+
+	return &Token{
+		Login:     m.families[family].login,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// cleanup drops expired tokens and families, must be called with the lock held
+func (m *MemoryRefreshTokens) cleanup() {
+	now := time.Now()
+	for hash, rt := range m.tokens {
+		if now.After(rt.expiresAt) {
+			delete(m.tokens, hash)
+		}
+	}
+	for id, family := range m.families {
+		if now.After(family.expiresAt) {
+			delete(m.families, id)
+		}
+	}
+}
+
+// randomString returns n random bytes encoded as url-safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns a hex encoded sha256 of a token, so tokens are never stored as is
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshRotation(t *testing.T) {
+	rp := NewMemoryRefreshTokens(time.Minute)
+
+	first, err := rp.Issue("login")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, first.Token)
+	assert.Equal(t, "login", first.Login)
+
+	second, err := rp.Rotate(first.Token)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Token, second.Token)
+	assert.Equal(t, "login", second.Login)
+
+	third, err := rp.Rotate(second.Token)
+	assert.NoError(t, err)
+
+	// reusing a rotated token revokes the whole family
+	reused, err := rp.Rotate(first.Token)
+	assert.EqualError(t, err, ErrRefreshTokenReused)
+	assert.Empty(t, reused)
+
+	revoked, err := rp.Rotate(third.Token)
+	assert.EqualError(t, err, ErrRefreshTokenInvalid)
+	assert.Empty(t, revoked)
+
+	// unknown token
+	unknown, err := rp.Rotate("unknown")
+	assert.EqualError(t, err, ErrRefreshTokenInvalid)
+	assert.Empty(t, unknown)
+}
+
+func TestRefreshExpiredAndRevokeLogin(t *testing.T) {
+	rp := NewMemoryRefreshTokens(time.Second)
+
+	expired, err := rp.Issue("login")
+	assert.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	_, err = rp.Rotate(expired.Token)
+	assert.EqualError(t, err, ErrRefreshTokenInvalid)
+
+	rp = NewMemoryRefreshTokens(time.Minute)
+	first, err := rp.Issue("login")
+	assert.NoError(t, err)
+	second, err := rp.Issue("login")
+	assert.NoError(t, err)
+	other, err := rp.Issue("other")
+	assert.NoError(t, err)
+
+	assert.NoError(t, rp.RevokeLogin("login"))
+
+	_, err = rp.Rotate(first.Token)
+	assert.Error(t, err)
+	_, err = rp.Rotate(second.Token)
+	assert.Error(t, err)
+	_, err = rp.Rotate(other.Token)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const ErrResetTokenInvalid = "invalid or used password reset token"
+
+// ResetProvider keeps single-use tokens of mailed links, like password reset links and magic links
+type ResetProvider interface {
+	// Issue() creates a token for a given login,
+	// earlier tokens of the login stop working
+	Issue(login string) (*Token, error)
+	// Login() returns the login of a valid reset token, without redeeming it
+	Login(token string) (string, error)
+	// Redeem() returns the login of a reset token, each token can be redeemed once
+	Redeem(token string) (string, error)
+}
+
+// MemoryResetTokens keeps opaque single-use tokens in memory, tokens are
+// stored hashed and only the last token of a login is valid
+type MemoryResetTokens struct {
+	ExpirationTime time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*resetToken // by token hash
+}
+
+type resetToken struct {
+	login     string
+	expiresAt time.Time
+}
+
+func NewMemoryResetTokens(exp time.Duration) *MemoryResetTokens {
+	return &MemoryResetTokens{
+		ExpirationTime: exp,
+		tokens:         make(map[string]*resetToken),
+	}
+}
+
+// Issue() creates a reset token for a given login, replacing earlier ones
+func (m *MemoryResetTokens) Issue(login string) (*Token, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for hash, rt := range m.tokens {
+		if rt.login == login || now.After(rt.expiresAt) {
+			delete(m.tokens, hash)
+		}
+	}
+
+	expiresAt := now.Add(m.ExpirationTime)
+	m.tokens[hashToken(token)] = &resetToken{login: login, expiresAt: expiresAt}
+	return &Token{Login: login, Token: token, IssuedAt: now, ExpiresAt: expiresAt}, nil
+}
+
+// Login() returns the login of a valid reset token
+func (m *MemoryResetTokens) Login(token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rt, ok := m.tokens[hashToken(token)]
+	if !ok || time.Now().After(rt.expiresAt) {
+		return "", errors.New(ErrResetTokenInvalid)
+	}
+	return rt.login, nil
+}
+
+// Redeem() returns the login of a reset token and forgets the token
+func (m *MemoryResetTokens) Redeem(token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hash := hashToken(token)
+	rt, ok := m.tokens[hash]
+	if !ok {
+		return "", errors.New(ErrResetTokenInvalid)
+	}
+	delete(m.tokens, hash)
+	if time.Now().After(rt.expiresAt) {
+		return "", errors.New(ErrResetTokenInvalid)
+	}
+	return rt.login, nil
+}
+
+// ForgotPassword - mails a password reset link to a user. Unknown logins are
+// ignored without an error, mail to existing ones may still fail or take a while,
+// so HandlePasswordForgot sends it in the background not to tell logins apart
+func (s *AuthService) ForgotPassword(ctx context.Context, login string) error {
+	if s.Mailer == nil || s.ResetTokens == nil {
+		return errors.New(ErrMailerNotConfigured)
+	}
+	user, err := s.Users.Get(login)
+	if err != nil {
+		if err.Error() == ErrUserNotFound {
+			return nil
+		}
+		return err
+	}
+
+	token, err := s.ResetTokens.Issue(user.Login)
+	if err != nil {
+		return err
+	}
+	link := s.BaseURL + "/password/reset?token=" + url.QueryEscape(token.Token)
+	return s.Mailer.Send(ctx, Message{
+		To:      s.mailAddress(user),
+		Subject: "Reset your password for " + s.Realm,
+		Body: fmt.Sprintf("Follow the link to set a new password of %s:\n\n%s\n\nThe link works once and expires at %s.\n"+
+			"If you didn't ask for it, ignore this message, your password stays the same.\n",
+			user.Login, link, token.ExpiresAt.Format(time.RFC1123)),
+	})
+}
+
+// ResetPassword - sets a new password with the token of a reset link, returns
+// the login. All sessions and refresh tokens of the user are revoked and a locked
+// out login is unlocked. A password violating the password policy doesn't use the token up
+func (s *AuthService) ResetPassword(token, password string) (string, error) {
+	if s.ResetTokens == nil {
+		return "", errors.New(ErrResetTokenInvalid)
+	}
+	login, err := s.ResetTokens.Login(token)
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkPassword(login, password); err != nil {
+		return "", err
+	}
+	hash, err := s.Hasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	// sessions of whoever knew the old password end before the new one is set
+	if err := s.LogoutAll(login); err != nil {
+		return "", err
+	}
+	// a concurrent reset may have redeemed the token meanwhile
+	if login, err = s.ResetTokens.Redeem(token); err != nil {
+		return "", err
+	}
+
+	err = s.updateUser(login, func(u *User) bool {
+		u.Password = hash
+		// the link was mailed to the email, following it proves the address
+		if s.unverified(u) {
+			u.EmailVerified = true
+		}
+		return true
+	})
+	if err != nil {
+		if err.Error() == ErrUserNotFound {
+			return "", errors.New(ErrResetTokenInvalid)
+		}
+		return "", err
+	}
+
+	// the owner of the login proved themselves, guesses of the old password don't matter
+	if err := s.UnlockSignin(login, ""); err != nil {
+		log.Printf("[WARN] failed to unlock signin of %s, %v", login, err)
+	}
+	return login, nil
+}
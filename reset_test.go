@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryResetTokens(t *testing.T) {
+	rt := NewMemoryResetTokens(time.Minute)
+	first, err := rt.Issue("user1")
+	assert.NoError(t, err)
+	other, err := rt.Issue("user2")
+	assert.NoError(t, err)
+
+	// only the last token of a login is valid
+	second, err := rt.Issue("user1")
+	assert.NoError(t, err)
+	_, err = rt.Redeem(first.Token)
+	assert.EqualError(t, err, ErrResetTokenInvalid)
+
+	login, err := rt.Redeem(second.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+	_, err = rt.Redeem(second.Token)
+	assert.EqualError(t, err, ErrResetTokenInvalid)
+
+	login, err = rt.Redeem(other.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user2", login)
+
+	// tokens are stored hashed
+	third, err := rt.Issue("user1")
+	assert.NoError(t, err)
+	_, ok := rt.tokens[third.Token]
+	assert.False(t, ok)
+
+	rt.ExpirationTime = -time.Second
+	expired, err := rt.Issue("user1")
+	assert.NoError(t, err)
+	_, err = rt.Redeem(expired.Token)
+	assert.EqualError(t, err, ErrResetTokenInvalid)
+}
+
+func TestResetPassword(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth"))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	// unknown logins get no mail and no error
+	assert.NoError(t, service.ForgotPassword(context.Background(), "unknown"))
+	assert.Empty(t, outbox.Messages())
+
+	assert.NoError(t, service.ForgotPassword(context.Background(), "user1"))
+	link := lastLink(t, outbox)
+	assert.Equal(t, "/auth/password/reset", link.Path)
+	token := link.Query().Get("token")
+
+	_, err = service.ResetPassword("invalid", "password2")
+	assert.EqualError(t, err, ErrResetTokenInvalid)
+	login, err := service.ResetPassword(token, "password2")
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+	_, err = service.ResetPassword(token, "password3")
+	assert.EqualError(t, err, ErrResetTokenInvalid)
+
+	_, err = service.Signin("user1", "password1")
+	assert.EqualError(t, err, ErrWrongPassword)
+	_, err = service.Signin("user1", "password2")
+	assert.NoError(t, err)
+
+	// sessions issued before the reset are revoked
+	_, err = service.Check(session.Access.Token)
+	assert.EqualError(t, err, ErrTokenRevoked)
+	_, err = service.Refresh(session.Refresh.Token)
+	assert.Error(t, err)
+
+	service.Mailer = nil
+	assert.EqualError(t, service.ForgotPassword(context.Background(), "user1"), ErrMailerNotConfigured)
+}
+
+func TestResetPasswordWithoutRevocations(t *testing.T) {
+	// access tokens can't be revoked, refresh tokens still are
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+
+	reset, err := service.ResetTokens.Issue("user1")
+	assert.NoError(t, err)
+	_, err = service.ResetPassword(reset.Token, "password2")
+	assert.NoError(t, err)
+
+	_, err = service.Refresh(session.Refresh.Token)
+	assert.Error(t, err)
+	_, err = service.Signin("user1", "password2")
+	assert.NoError(t, err)
+}
+
+func TestHandlePasswordReset(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	outbox := NewOutbox("")
+	service := NewAuthService(tp, NewUsers(), Mail(outbox, "https://example.com/auth"))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	// the same response for existing and unknown logins
+	known, unknown := do("POST", "/auth/password/forgot", `{"login": "user1"}`), do("POST", "/auth/password/forgot", `{"login": "unknown"}`)
+	service.WaitMail()
+	assert.Equal(t, http.StatusAccepted, known.Code)
+	assert.Equal(t, known.Code, unknown.Code)
+	assert.Equal(t, known.Body.String(), unknown.Body.String())
+	assert.Len(t, outbox.Messages(), 1)
+
+	link := lastLink(t, outbox)
+	assert.Equal(t, http.StatusMethodNotAllowed, do("GET", link.RequestURI(), "").Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/auth/password/reset", `{"token": "invalid", "password": "password2"}`).Code)
+	assert.Equal(t, http.StatusOK, do("POST", link.RequestURI(), `{"password": "password2"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", link.RequestURI(), `{"password": "password3"}`).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/auth/signin", `{"login": "user1", "password": "password2"}`).Code)
+
+	service.Mailer = nil
+	assert.Equal(t, http.StatusNotImplemented, do("POST", "/auth/password/forgot", `{"login": "user1"}`).Code)
+}
+
+// brokenMailer fails every message after a while, like an unreachable SMTP server
+type brokenMailer struct {
+	delay time.Duration
+}
+
+func (m brokenMailer) Send(context.Context, Message) error {
+	time.Sleep(m.delay)
+	return errors.New("connection refused")
+}
+
+func TestHandleMailFailure(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers(), Mail(brokenMailer{delay: 200 * time.Millisecond}, "https://example.com/auth"))
+	assert.NoError(t, service.SignupEmail(context.Background(), "user1", "password1", "user1@example.com"))
+	handler := service.Handlers("/auth")
+
+	// mail to existing logins neither fails nor delays the response
+	for _, path := range []string{"/auth/password/forgot", "/auth/magic-link", "/auth/verify-email/resend"} {
+		for _, login := range []string{"user1", "unknown"} {
+			req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"login": "`+login+`"}`))
+			response := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(response, req)
+			assert.Less(t, time.Since(start), 100*time.Millisecond, path)
+			assert.Equal(t, http.StatusAccepted, response.Code, path)
+			assert.JSONEq(t, `{"status": "OK"}`, response.Body.String(), path)
+		}
+	}
+	service.WaitMail()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const ErrTokenRevoked = "token revoked"
+
+type RevocationStore interface {
+	// Revoke() revokes a token by its ID (jti) until the token expires
+	Revoke(id string, expiresAt time.Time) error
+	// RevokeLogin() revokes all tokens of a login issued so far
+	RevokeLogin(login string) error
+	// Generation() returns the generation new tokens of a login are issued in,
+	// RevokeLogin() advances it
+	Generation(login string) (int, error)
+	// IsRevoked() checks if a token with a given ID, issued to a login in a given generation, is revoked
+	IsRevoked(id, login string, generation int) (bool, error)
+}
+
+// revocations is the state shared by the revocation stores
+type revocations struct {
+	// Tokens are revoked token IDs with their expiration time
+	Tokens map[string]time.Time `json:"tokens"`
+	// Generations count revocations of all tokens of a login, tokens carry the generation
+	// they were issued in. Unlike a cut-off time it doesn't depend on the precision of `iat`
+	Generations map[string]int `json:"generations"`
+}
+
+func newRevocations() revocations {
+	return revocations{Tokens: make(map[string]time.Time), Generations: make(map[string]int)}
+}
+
+func (r *revocations) revoke(id string, expiresAt time.Time) {
+	// expired tokens are rejected anyway, no need to keep them
+	now := time.Now()
+	for id, exp := range r.Tokens {
+		if now.After(exp) {
+			delete(r.Tokens, id)
+		}
+	}
+	r.Tokens[id] = expiresAt
+}
+
+func (r *revocations) revokeLogin(login string) {
+	r.Generations[login]++
+}
+
+// isRevoked checks the token ID and the generation of the login
+func (r *revocations) isRevoked(id, login string, generation int) bool {
+	if _, ok := r.Tokens[id]; ok && id != "" {
+		return true
+	}
+	return generation < r.Generations[login]
+}
+
+// MemoryRevocations keeps revoked tokens in memory, revocations are lost on restart
+type MemoryRevocations struct {
+	mu    sync.RWMutex
+	state revocations
+}
+
+func NewMemoryRevocations() *MemoryRevocations {
+	return &MemoryRevocations{state: newRevocations()}
+}
+
+// Revoke() revokes a token by its ID until the token expires
+func (m *MemoryRevocations) Revoke(id string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.revoke(id, expiresAt)
+	return nil
+}
+
+// RevokeLogin() revokes all tokens of a login issued so far
+func (m *MemoryRevocations) RevokeLogin(login string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state.revokeLogin(login)
+	return nil
+}
+
+// Generation() returns the generation new tokens of a login are issued in
+func (m *MemoryRevocations) Generation(login string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.Generations[login], nil
+}
+
+// IsRevoked() checks if a token is revoked
+func (m *MemoryRevocations) IsRevoked(id, login string, generation int) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.state.isRevoked(id, login, generation), nil
+}
+
+// FileRevocations keeps revoked tokens in a json file, rewritten atomically on every change
+type FileRevocations struct {
+	path  string
+	mu    sync.RWMutex
+	state revocations
+}
+
+// NewFileRevocations - loads revocations from a given file, the file is created on the first change
+func NewFileRevocations(path string) (*FileRevocations, error) {
+	f := &FileRevocations{path: path, state: newRevocations()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.state); err != nil {
+		return nil, err
+	}
+	if f.state.Tokens == nil {
+		f.state.Tokens = make(map[string]time.Time)
+	}
+	if f.state.Generations == nil {
+		f.state.Generations = make(map[string]int)
+	}
+	return f, nil
+}
+
+// Revoke() revokes a token by its ID until the token expires
+func (f *FileRevocations) Revoke(id string, expiresAt time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.revoke(id, expiresAt)
+	return f.save()
+}
+
+// RevokeLogin() revokes all tokens of a login issued so far
+func (f *FileRevocations) RevokeLogin(login string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state.revokeLogin(login)
+	return f.save()
+}
+
+// Generation() returns the generation new tokens of a login are issued in
+func (f *FileRevocations) Generation(login string) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.state.Generations[login], nil
+}
+
+// IsRevoked() checks if a token is revoked
+func (f *FileRevocations) IsRevoked(id, login string, generation int) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.state.isRevoked(id, login, generation), nil
+}
+
+// save writes the state to the file, must be called with the lock held
+func (f *FileRevocations) save() error {
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data, 0o600)
+}
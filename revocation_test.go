@@ -0,0 +1,72 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationStores(t *testing.T) {
+	fileStore, err := NewFileRevocations(filepath.Join(t.TempDir(), "revoked.json"))
+	assert.NoError(t, err)
+
+	for name, store := range map[string]RevocationStore{"memory": NewMemoryRevocations(), "file": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+
+			revoked, err := store.IsRevoked("id1", "login", 0)
+			assert.NoError(t, err)
+			assert.False(t, revoked)
+
+			assert.NoError(t, store.Revoke("id1", now.Add(time.Minute)))
+			revoked, err = store.IsRevoked("id1", "login", 0)
+			assert.NoError(t, err)
+			assert.True(t, revoked)
+
+			generation, err := store.Generation("login")
+			assert.NoError(t, err)
+			assert.NoError(t, store.RevokeLogin("login"))
+			revoked, err = store.IsRevoked("id2", "login", generation)
+			assert.NoError(t, err)
+			assert.True(t, revoked)
+
+			// tokens issued right after are valid, however soon
+			generation, err = store.Generation("login")
+			assert.NoError(t, err)
+			revoked, err = store.IsRevoked("id2", "login", generation)
+			assert.NoError(t, err)
+			assert.False(t, revoked)
+
+			revoked, err = store.IsRevoked("id2", "other", 0)
+			assert.NoError(t, err)
+			assert.False(t, revoked)
+		})
+	}
+}
+
+func TestFileRevocationsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	now := time.Now()
+
+	store, err := NewFileRevocations(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Revoke("id1", now.Add(time.Minute)))
+	assert.NoError(t, store.RevokeLogin("login"))
+
+	// reloaded store keeps revocations
+	store, err = NewFileRevocations(path)
+	assert.NoError(t, err)
+
+	revoked, err := store.IsRevoked("id1", "other", 0)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = store.IsRevoked("id2", "login", 0)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+	generation, err := store.Generation("login")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, generation)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+)
+
+// HasRole checks if the principal has a given role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole - middleware letting through principals with a given role,
+// has to be used after the Auth middleware
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return RequireAnyRole(role)
+}
+
+// RequireAnyRole - middleware letting through principals with at least one of given roles,
+// has to be used after the Auth middleware. Responds 401 without a principal
+// and 403 if none of the roles is granted
+func RequireAnyRole(roles ...string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			for _, role := range roles {
+				if p.HasRole(role) {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusForbidden)
+		})
+	}
+}
+
+// GrantRole - grants a role to a user, tokens get it on the next signin or refresh
+func (s *AuthService) GrantRole(login, role string) error {
+	return s.updateUser(login, func(u *User) bool {
+		return addString(&u.Roles, role)
+	})
+}
+
+// RevokeRole - revokes a role of a user, tokens issued before keep it until
+// they expire, use LogoutAll to drop it immediately
+func (s *AuthService) RevokeRole(login, role string) error {
+	return s.updateUser(login, func(u *User) bool {
+		return removeString(&u.Roles, role)
+	})
+}
+
+// errUnchanged is returned by changes of updateUser with nothing to store
+var errUnchanged = errors.New("user unchanged")
+
+// updateUser applies a change to a user atomically and stores it, if the change reports it changed anything
+func (s *AuthService) updateUser(login string, change func(*User) bool) error {
+	err := s.Users.Modify(login, func(u *User) error {
+		if !change(u) {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return nil
+	}
+	return err
+}
+
+// addString adds a value to a sorted list, unless it's there already
+func addString(list *[]string, value string) bool {
+	for _, v := range *list {
+		if v == value {
+			return false
+		}
+	}
+	*list = append(*list, value)
+	sort.Strings(*list)
+	return true
+}
+
+// removeString removes a value from a list, if it's there
+func removeString(list *[]string, value string) bool {
+	kept := make([]string, 0, len(*list))
+	for _, v := range *list {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == len(*list) {
+		return false
+	}
+	*list = kept
+	return true
+}
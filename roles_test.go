@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireRole(t *testing.T) {
+	handler := RequireAnyRole("admin", "editor")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tt := range []struct {
+		name      string
+		principal *Principal
+		code      int
+	}{
+		{"no principal", nil, http.StatusUnauthorized},
+		{"no roles", &Principal{Login: "user1"}, http.StatusForbidden},
+		{"other role", &Principal{Login: "user1", Roles: []string{"viewer"}}, http.StatusForbidden},
+		{"first role", &Principal{Login: "user1", Roles: []string{"admin"}}, http.StatusOK},
+		{"second role", &Principal{Login: "user1", Roles: []string{"viewer", "editor"}}, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin", nil)
+			if tt.principal != nil {
+				req = WithPrincipal(req, tt.principal)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, req)
+			assert.Equal(t, tt.code, response.Code)
+		})
+	}
+}
+
+func TestGrantRevokeRole(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+
+	assert.NoError(t, service.GrantRole("user1", "editor"))
+	assert.NoError(t, service.GrantRole("user1", "admin"))
+	assert.NoError(t, service.GrantRole("user1", "admin"))
+	user, err := service.Users.Get("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin", "editor"}, user.Roles)
+	assert.EqualError(t, service.GrantRole("unknown", "admin"), ErrUserNotFound)
+
+	// roles are carried by the token and put into the principal
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin", "editor"}, session.Access.Roles)
+	p, err := service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.True(t, p.HasRole("admin"))
+
+	// a revoked role disappears from tokens issued on refresh
+	assert.NoError(t, service.RevokeRole("user1", "admin"))
+	assert.NoError(t, service.RevokeRole("user1", "admin"))
+	refreshed, err := service.Refresh(session.Refresh.Token)
+	assert.NoError(t, err)
+	p, err = service.Authenticate(refreshed.Access.Token)
+	assert.NoError(t, err)
+	assert.False(t, p.HasRole("admin"))
+	assert.True(t, p.HasRole("editor"))
+
+	// token refresh keeps roles of the original token
+	token, err := tp.Refresh(refreshed.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"editor"}, token.Roles)
+}
+
+func TestSQLUsersRolesMigration(t *testing.T) {
+	up, err := NewSQLUsers(filepath.Join(t.TempDir(), "auth.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { up.Close() })
+
+	// a database of schema version 1, before the roles column
+	for _, stmt := range []string{
+		`CREATE TABLE users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			login TEXT NOT NULL,
+			password BLOB NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE UNIQUE INDEX idx_users_login ON users (login)`,
+		`INSERT INTO schema_migrations (version, description) VALUES (1, 'create users')`,
+		`INSERT INTO users (login, password) VALUES ('user1', 'hash1')`,
+	} {
+		_, err := up.db.Exec(stmt)
+		assert.NoError(t, err)
+	}
+
+	applied, err := up.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, len(sqlMigrations)-1, applied)
+
+	// users created before the roles column have no roles, and can get some
+	user, err := up.Get("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash1", user.Password)
+	assert.Empty(t, user.Roles)
+	user.Roles = []string{"admin"}
+	assert.NoError(t, up.Update(*user))
+	user, err = up.Get("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, user.Roles)
+}
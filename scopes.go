@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	ErrScopeNotGranted = "scope not granted"
+	ErrNoScopes        = "no scopes requested"
+	ErrTokenDownscoped = "downscoped tokens aren't allowed"
+)
+
+// ScopeMatches checks if a granted scope covers a required one. Scopes are
+// `:`-separated segments, a `*` segment matches any single segment and a trailing
+// `*` matches the rest, so `orders:*` covers `orders:read` and `*` covers everything
+func ScopeMatches(granted, required string) bool {
+	g := strings.Split(granted, ":")
+	r := strings.Split(required, ":")
+	for i, seg := range g {
+		if seg == "*" && i == len(g)-1 {
+			return len(r) >= len(g)
+		}
+		if i >= len(r) || (seg != "*" && seg != r[i]) {
+			return false
+		}
+	}
+	return len(g) == len(r)
+}
+
+// HasScope checks if any of the principal's scopes covers a given one
+func (p *Principal) HasScope(scope string) bool {
+	for _, g := range p.Scopes {
+		if ScopeMatches(g, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScopes - middleware letting through principals with all of given scopes,
+// has to be used after the Auth middleware. Responds 401 without a principal
+// and 403 with an `insufficient_scope` challenge if a scope is missing
+func RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			for _, scope := range scopes {
+				if !p.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate",
+						fmt.Sprintf("Bearer error=\"insufficient_scope\", scope=%q", strings.Join(scopes, " ")))
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSession - middleware letting through principals of a signin session only,
+// has to be used after the Auth middleware. Tokens minted by Downscope are meant
+// for resource servers, they get 403 on the endpoints managing the account
+func RequireSession(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if p.Downscoped {
+			writeDownscoped(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeDownscoped responds 403 to a downscoped token
+func writeDownscoped(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"insufficient_scope\", error_description=%q", ErrTokenDownscoped))
+	w.WriteHeader(http.StatusForbidden)
+}
+
+// ScopeNotGrantedError is returned on downscoping to a scope the token doesn't have
+type ScopeNotGrantedError struct {
+	Scope string
+}
+
+func (e *ScopeNotGrantedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrScopeNotGranted, e.Scope)
+}
+
+// GrantScope - grants a scope to a user, tokens get it on the next signin or refresh
+func (s *AuthService) GrantScope(login, scope string) error {
+	return s.updateUser(login, func(u *User) bool {
+		return addString(&u.Scopes, scope)
+	})
+}
+
+// RevokeScope - revokes a scope of a user, tokens issued before keep it until they expire
+func (s *AuthService) RevokeScope(login, scope string) error {
+	return s.updateUser(login, func(u *User) bool {
+		return removeString(&u.Scopes, scope)
+	})
+}
+
+// Downscope - mints a token with a subset of scopes of a given token, e.g. to hand
+// over to a less trusted service. The new token carries no roles, expires
+// no later than the original one, has no refresh token and is rejected
+// by RequireSession, so it can't manage the account
+func (s *AuthService) Downscope(token string, scopes []string) (*Token, error) {
+	if len(scopes) == 0 {
+		return nil, errors.New(ErrNoScopes)
+	}
+	p, err := s.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+	return s.downscope(p, scopes)
+}
+
+// downscope mints a downscoped token for an authenticated principal
+func (s *AuthService) downscope(p *Principal, scopes []string) (*Token, error) {
+	for _, scope := range scopes {
+		if !p.HasScope(scope) {
+			return nil, &ScopeNotGrantedError{Scope: scope}
+		}
+	}
+	return s.Tokens.New(p.Login, WithScopes(scopes...), WithExpiresAt(p.ExpiresAt), WithDownscoped())
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopeMatches(t *testing.T) {
+	for _, tt := range []struct {
+		granted, required string
+		match             bool
+	}{
+		{"orders:read", "orders:read", true},
+		{"orders:read", "orders:write", false},
+		{"orders:*", "orders:read", true},
+		{"orders:*", "orders:items:read", true},
+		{"orders:*", "orders", false},
+		{"orders:*", "users:read", false},
+		{"*:read", "orders:read", true},
+		{"*:read", "orders:write", false},
+		{"*", "orders:read", true},
+		{"orders", "orders:read", false},
+		{"orders:read", "orders", false},
+		{"orders:*", "*", false},
+	} {
+		assert.Equal(t, tt.match, ScopeMatches(tt.granted, tt.required), "%s covers %s", tt.granted, tt.required)
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	handler := RequireScopes("orders:read", "orders:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/orders", nil)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, WithPrincipal(req, &Principal{Login: "user1", Scopes: []string{"orders:read"}}))
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="orders:read orders:write"`, response.Header().Get("WWW-Authenticate"))
+
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, WithPrincipal(req, &Principal{Login: "user1", Scopes: []string{"orders:*"}}))
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestDownscope(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	assert.NoError(t, service.GrantRole("user1", "admin"))
+	assert.NoError(t, service.GrantScope("user1", "orders:*"))
+	assert.NoError(t, service.GrantScope("user1", "users:read"))
+
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	p, err := service.Authenticate(session.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders:*", "users:read"}, p.Scopes)
+
+	token, err := service.Downscope(session.Access.Token, []string{"orders:read"})
+	assert.NoError(t, err)
+	assert.False(t, token.ExpiresAt.After(session.Access.ExpiresAt))
+	p, err = service.Authenticate(token.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", p.Login)
+	assert.Equal(t, []string{"orders:read"}, p.Scopes)
+	assert.Empty(t, p.Roles)
+	assert.True(t, p.Downscoped)
+
+	// a downscoped token can't be extended
+	_, err = tp.Refresh(token.Token)
+	assert.EqualError(t, err, ErrTokenDownscoped)
+
+	// a downscoped token can't be widened back
+	_, err = service.Downscope(token.Token, []string{"orders:write"})
+	assert.EqualError(t, err, ErrScopeNotGranted+": orders:write")
+	_, err = service.Downscope(session.Access.Token, []string{"*"})
+	assert.Error(t, err)
+	_, err = service.Downscope(session.Access.Token, nil)
+	assert.EqualError(t, err, ErrNoScopes)
+
+	// revoked scopes aren't granted on the next signin
+	assert.NoError(t, service.RevokeScope("user1", "orders:*"))
+	session, err = service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"users:read"}, session.Access.Scopes)
+}
+
+func TestHandleDownscope(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	assert.NoError(t, service.GrantScope("user1", "orders:*"))
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	downscope := func(token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth/downscope", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	response := downscope(session.Access.Token, `{"scopes":["orders:read"]}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var result struct {
+		Token  string   `json:"token"`
+		Scopes []string `json:"scopes"`
+	}
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&result))
+	assert.Equal(t, []string{"orders:read"}, result.Scopes)
+	p, err := service.Authenticate(result.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders:read"}, p.Scopes)
+
+	response = downscope(session.Access.Token, `{"scopes":["users:read"]}`)
+	assert.Equal(t, http.StatusForbidden, response.Code)
+	assert.JSONEq(t, `{"error":"invalid_scope","scope":"users:read"}`, response.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, downscope(session.Access.Token, `{"scopes":[]}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, downscope("", `{"scopes":["orders:read"]}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, downscope("garbage", `{"scopes":["orders:read"]}`).Code)
+
+	// downscoped tokens can't manage the account
+	for _, path := range []string{"/auth/webauthn/register/begin", "/auth/webauthn/register/finish",
+		"/auth/mfa/totp/enroll", "/auth/mfa/recovery-codes", "/auth/password/change", "/auth/logout/all", "/auth/downscope"} {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{"scopes":["orders:read"]}`))
+		req.Header.Set("Authorization", "Bearer "+result.Token)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusForbidden, response.Code, path)
+		assert.Contains(t, response.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`, path)
+	}
+	req, _ := http.NewRequest("GET", "/auth/check", nil)
+	req.Header.Set("Authorization", "Bearer "+result.Token)
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
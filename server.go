@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -13,9 +15,100 @@ import (
 )
 
 func main() {
-	tp := NewJwtProvider(ExpirationTime(5*time.Minute), Key("my_secret_key"))
-	up := NewUsers()
-	auth := NewAuthService(tp, up)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-passwords" {
+		migratePasswords(os.Args[2:])
+		return
+	}
+
+	store := flag.String("store", "file", "user store, file or sqlite")
+	usersFile := flag.String("users", "users.json", "file to keep users in, for the file store")
+	dbFile := flag.String("db", "auth.db", "SQLite database, for the sqlite store")
+	revokedFile := flag.String("revoked", "revoked.json", "file to keep revoked tokens in")
+	hasher := flag.String("hasher", "argon2id", "password hashing algorithm, argon2id or pbkdf2-sha256")
+	admin := flag.String("admin", "", "login to grant the admin role at startup")
+	rpID := flag.String("rp-id", "", "WebAuthn relying party id, e.g. example.com, enables passkeys")
+	rpOrigin := flag.String("rp-origin", "", "origin passkey ceremonies are accepted from, e.g. https://example.com")
+	smtpAddr := flag.String("smtp", "", "SMTP server host:port to send mail through")
+	smtpFrom := flag.String("smtp-from", "auth@localhost", "sender address of mail")
+	smtpUser := flag.String("smtp-user", "", "SMTP username, the password is taken from $SMTP_PASSWORD")
+	outbox := flag.String("outbox", "", "file to write mail to instead of sending it, for development")
+	baseURL := flag.String("base-url", "http://localhost:8000/auth", "public URL of the auth handlers, for links in mail")
+	unverified := flag.String("unverified", "allow", "signin of users with an unverified email, allow, restrict or reject")
+	maxFailures := flag.Int("max-failures", 10, "failed signins of a login to lock it for 15 minutes, 0 disables the lockout")
+	rateLimit := flag.Bool("rate-limit", true, "limit requests per client IP and login, see DefaultRateLimits")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated proxy addresses and CIDRs trusted to set X-Forwarded-For")
+	minStrength := flag.Int("password-strength", 0, "minimum password strength score of new passwords, 0 to 4")
+	compromised := flag.String("compromised-passwords", "", "file of known passwords to reject, plain or SHA-1 hashes per line")
+	policyFile := flag.String("policy", "", "YAML or JSON policy file for authorization decisions, reloaded on change")
+	flag.Parse()
+
+	up, closeUsers := openUsers(*store, *usersFile, *dbFile)
+	defer closeUsers()
+
+	revoked, err := NewFileRevocations(*revokedFile)
+	if err != nil {
+		log.Fatalf("[ERROR] failed to load revoked tokens from %s, %v", *revokedFile, err)
+	}
+
+	tp := NewJwtProvider(ExpirationTime(5*time.Minute), Key("my_secret_key"), Revocations(revoked))
+	opts := []AuthServiceOption{Hasher(NewHashers(primaryHasher(*hasher)))}
+	var policy *PolicyEngine
+	if *policyFile != "" {
+		if policy, err = NewPolicyEngine(*policyFile); err != nil {
+			log.Fatalf("[ERROR] failed to load policy, %v", err)
+		}
+		opts = append(opts, Policies(policy))
+	}
+
+	switch {
+	case *smtpAddr != "":
+		opts = append(opts, Mail(NewSMTPMailer(*smtpAddr, *smtpFrom, *smtpUser, os.Getenv("SMTP_PASSWORD")), *baseURL))
+	case *outbox != "":
+		opts = append(opts, Mail(NewOutbox(*outbox), *baseURL))
+	}
+	passwords := DefaultPasswordPolicy()
+	passwords.MinStrength = *minStrength
+	if *compromised != "" {
+		if passwords.Compromised, err = LoadCompromisedPasswords(*compromised); err != nil {
+			log.Fatalf("[ERROR] failed to load compromised passwords, %v", err)
+		}
+		log.Printf("[INFO] %d compromised passwords loaded", passwords.Compromised.Len())
+	}
+	opts = append(opts, Passwords(passwords))
+	if *maxFailures > 0 {
+		lockout := NewLockout(NewMemoryLockoutStore())
+		lockout.MaxFailures = *maxFailures
+		opts = append(opts, Lockouts(lockout))
+	} else {
+		opts = append(opts, Lockouts(nil))
+	}
+	if !*rateLimit {
+		opts = append(opts, RateLimits(nil))
+	}
+	proxies, err := ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	opts = append(opts, TrustedProxies(proxies...))
+	unverifiedPolicy, err := ParseUnverifiedPolicy(*unverified)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	opts = append(opts, EmailVerification(unverifiedPolicy))
+	if *rpID != "" {
+		opts = append(opts, Passkeys(NewWebAuthn(*rpID, "auth", *rpOrigin)))
+	}
+
+	auth := NewAuthService(tp, up, opts...)
+	if *admin != "" {
+		if err := auth.GrantRole(*admin, "admin"); err != nil {
+			log.Fatalf("[ERROR] failed to grant admin role to %s, %v", *admin, err)
+		}
+	}
 	handlers := auth.Handlers("/auth")
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -33,12 +126,15 @@ func main() {
 		cancel()
 	}()
 
+	if policy != nil {
+		go policy.Watch(ctx, 5*time.Second)
+	}
+
 	router := chi.NewRouter()
 	router.Mount("/auth", handlers)
 
-	router.With(auth.Auth).Get("/membersonly", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Members only area, congrats!"))
-	})
+	router.With(auth.Auth).Get("/membersonly", membersOnly)
+	router.With(auth.Auth, RequireRole("admin")).Get("/adminsonly", adminsOnly)
 
 	httpServer := &http.Server{
 		Addr:              ":8000",
@@ -59,4 +155,122 @@ func main() {
 	}()
 
 	httpServer.ListenAndServe()
+	auth.WaitMail()
+}
+
+// membersOnly greets the caller authenticated by the Auth middleware
+func membersOnly(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprintf(w, "Members only area, congrats, %s!", p.Login)
+}
+
+// adminsOnly greets the caller with the admin role
+func adminsOnly(w http.ResponseWriter, r *http.Request) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprintf(w, "Admins only area, welcome, %s!", p.Login)
+}
+
+// migrate applies pending schema migrations to the SQLite user store
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbFile := fs.String("db", "auth.db", "SQLite database to migrate")
+	fs.Parse(args)
+
+	su, err := NewSQLUsers(*dbFile)
+	if err != nil {
+		log.Fatalf("[ERROR] failed to open %s, %v", *dbFile, err)
+	}
+	defer su.Close()
+
+	applied, err := su.Migrate()
+	if err != nil {
+		log.Fatalf("[ERROR] failed to migrate %s, %v", *dbFile, err)
+	}
+	_, latest, _ := su.SchemaVersion()
+	log.Printf("[INFO] %s: %d migrations applied, schema version %d", *dbFile, applied, latest)
+}
+
+// openUsers opens the user store of a given kind, the schema of
+// a sqlite store has to be migrated already
+func openUsers(store, usersFile, dbFile string) (UserProvider, func()) {
+	switch store {
+	case "file":
+		fu, err := NewFileUsers(usersFile)
+		if err != nil {
+			log.Fatalf("[ERROR] failed to load users from %s, %v", usersFile, err)
+		}
+		return fu, func() {}
+	case "sqlite":
+		su, err := NewSQLUsers(dbFile)
+		if err != nil {
+			log.Fatalf("[ERROR] failed to open %s, %v", dbFile, err)
+		}
+		current, latest, err := su.SchemaVersion()
+		if err != nil {
+			log.Fatalf("[ERROR] failed to get schema version of %s, %v", dbFile, err)
+		}
+		if current != latest {
+			log.Fatalf("[ERROR] schema of %s is at version %d, expected %d, run `%s migrate -db %s`",
+				dbFile, current, latest, os.Args[0], dbFile)
+		}
+		return su, func() { su.Close() }
+	default:
+		log.Fatalf("[ERROR] unknown user store %q", store)
+	}
+	return nil, nil
+}
+
+// primaryHasher returns the hasher of new passwords by its name
+func primaryHasher(name string) PasswordHasher {
+	switch name {
+	case "argon2id":
+		return NewArgon2Hasher(DefaultArgon2Params)
+	case "pbkdf2-sha256":
+		return NewPBKDF2Hasher(DefaultPBKDF2Params)
+	default:
+		log.Fatalf("[ERROR] unknown password hasher %q", name)
+	}
+	return nil
+}
+
+// migratePasswords hashes passwords stored in plaintext by early versions of the
+// http handlers, once. With -dry-run it only lists the users it would migrate
+func migratePasswords(args []string) {
+	fs := flag.NewFlagSet("migrate-passwords", flag.ExitOnError)
+	store := fs.String("store", "file", "user store, file or sqlite")
+	usersFile := fs.String("users", "users.json", "file to keep users in, for the file store")
+	dbFile := fs.String("db", "auth.db", "SQLite database, for the sqlite store")
+	hasher := fs.String("hasher", "argon2id", "password hashing algorithm, argon2id or pbkdf2-sha256")
+	dryRun := fs.Bool("dry-run", false, "list the users to migrate without changing them")
+	fs.Parse(args)
+
+	up, closeUsers := openUsers(*store, *usersFile, *dbFile)
+	defer closeUsers()
+
+	tp := NewJwtProvider(Key("my_secret_key"))
+	auth := NewAuthService(tp, up, Hasher(NewHashers(primaryHasher(*hasher))))
+	res, err := auth.MigratePlaintextPasswords(*dryRun)
+	for _, login := range res.Migrated {
+		log.Printf("[INFO] %s: plaintext password hashed", login)
+	}
+	for _, login := range res.Ambiguous {
+		log.Printf("[WARN] %s: password is either a legacy hash or a plaintext password of the same length, "+
+			"left as is, reset it if the user can't sign in", login)
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] failed to hash plaintext passwords, %v", err)
+	}
+	if *dryRun {
+		log.Printf("[INFO] dry run, %d plaintext passwords to hash", len(res.Migrated))
+		return
+	}
+	log.Printf("[INFO] %d plaintext passwords hashed", len(res.Migrated))
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+)
+
+// SQLUsers is a UserProvider backed by an embedded SQLite database,
+// the schema is versioned and has to be migrated with Migrate before use
+type SQLUsers struct {
+	db *sql.DB
+}
+
+// sqlMigration is a step of the schema, migrations are applied in order and
+// never changed once released, every schema change goes to a new one
+type sqlMigration struct {
+	description string
+	statements  []string
+}
+
+// sqlMigrations - schema version N is the result of applying the first N migrations
+var sqlMigrations = []sqlMigration{
+	{
+		description: "create users",
+		statements: []string{
+			`CREATE TABLE users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				login TEXT NOT NULL,
+				password BLOB NOT NULL,
+				created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			)`,
+			`CREATE UNIQUE INDEX idx_users_login ON users (login)`,
+		},
+	},
+	{
+		description: "add user roles",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN roles TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		description: "add user scopes",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN scopes TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		description: "add user attributes",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN attributes TEXT NOT NULL DEFAULT '{}'`,
+		},
+	},
+	{
+		description: "add user totp",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN totp_confirmed BOOLEAN NOT NULL DEFAULT FALSE`,
+			`ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		description: "add user recovery codes",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		description: "add user passkeys",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN credentials TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		description: "add user email",
+		statements: []string{
+			`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+		},
+	},
+}
+
+// NewSQLUsers - opens a SQLite database by a file name or a "file:" URI
+func NewSQLUsers(dsn string) (*SQLUsers, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`PRAGMA journal_mode = WAL`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLUsers{db: db}, nil
+}
+
+// Close - closes the database
+func (u *SQLUsers) Close() error {
+	return u.db.Close()
+}
+
+// SchemaVersion - returns the current and the latest schema versions
+func (u *SQLUsers) SchemaVersion() (current, latest int, err error) {
+	err = u.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	return current, len(sqlMigrations), err
+}
+
+// Migrate - applies pending migrations, each one in its own transaction,
+// returns the number of applied migrations
+func (u *SQLUsers) Migrate() (int, error) {
+	current, latest, err := u.SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	if current > latest {
+		return 0, fmt.Errorf("schema version %d is newer than supported %d", current, latest)
+	}
+
+	for v := current + 1; v <= latest; v++ {
+		if err := u.migrate(v, sqlMigrations[v-1]); err != nil {
+			return v - current - 1, fmt.Errorf("migration %d (%s): %w", v, sqlMigrations[v-1].description, err)
+		}
+	}
+	return latest - current, nil
+}
+
+func (u *SQLUsers) migrate(version int, m sqlMigration) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, description) VALUES (?, ?)`, version, m.description); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *SQLUsers) Get(login string) (*User, error) {
+	user, err := scanUser(u.db.QueryRow(`SELECT `+userSelect+` FROM users WHERE login = ?`, login))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New(ErrUserNotFound)
+	}
+	return user, err
+}
+
+func (u *SQLUsers) Create(user User) error {
+	values, err := userValues(user)
+	if err != nil {
+		return err
+	}
+	_, err = u.db.Exec(`INSERT INTO users (`+userSelect+`) VALUES (?`+strings.Repeat(", ?", len(userColumns))+`)`,
+		append([]any{user.Login}, values...)...)
+	if errors.Is(err, sqlite3.CONSTRAINT_UNIQUE) {
+		return &UserExistsError{Login: user.Login}
+	}
+	return err
+}
+
+func (u *SQLUsers) Update(user User) error {
+	return updateSQLUser(context.Background(), u.db, user)
+}
+
+// Modify - changes a user in a transaction. The user is touched first, which takes
+// the write lock, so concurrent changes wait for each other instead of failing on commit
+func (u *SQLUsers) Modify(login string, change func(*User) error) error {
+	ctx := context.Background()
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE users SET updated_at = CURRENT_TIMESTAMP WHERE login = ?`, login)
+	if err != nil {
+		return err
+	}
+	if err := expectAffected(res); err != nil {
+		return err
+	}
+	user, err := scanUser(tx.QueryRowContext(ctx, `SELECT `+userSelect+` FROM users WHERE login = ?`, login))
+	if err != nil {
+		return err
+	}
+	if err := change(user); err != nil {
+		return err
+	}
+	if err := updateSQLUser(ctx, tx, *user); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execer is a database or a transaction to run statements on
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func updateSQLUser(ctx context.Context, db execer, user User) error {
+	values, err := userValues(user)
+	if err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `UPDATE users SET `+strings.Join(userColumns, " = ?, ")+` = ?, updated_at = CURRENT_TIMESTAMP WHERE login = ?`,
+		append(values, user.Login)...)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (u *SQLUsers) Delete(login string) error {
+	res, err := u.db.Exec(`DELETE FROM users WHERE login = ?`, login)
+	if err != nil {
+		return err
+	}
+	return expectAffected(res)
+}
+
+func (u *SQLUsers) List(offset, limit int) ([]User, int, error) {
+	var total int
+	if err := u.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	if limit <= 0 {
+		limit = -1 // no limit in SQLite
+	}
+	rows, err := u.db.Query(`SELECT `+userSelect+` FROM users ORDER BY login LIMIT ? OFFSET ?`, limit, max(offset, 0))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, *user)
+	}
+	return users, total, rows.Err()
+}
+
+func (u *SQLUsers) Exists(login string) (bool, error) {
+	var exists bool
+	err := u.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE login = ?)`, login).Scan(&exists)
+	return exists, err
+}
+
+// expectAffected returns ErrUserNotFound if a statement changed no rows
+func expectAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New(ErrUserNotFound)
+	}
+	return nil
+}
+
+// userColumns are the columns of the users table besides login, in the order of userValues
+var userColumns = []string{"password", "roles", "scopes", "attributes", "totp_secret", "totp_confirmed", "totp_last_step", "recovery_codes", "credentials", "email", "email_verified"}
+
+var userSelect = "login, " + strings.Join(userColumns, ", ")
+
+// userValues returns values of userColumns for a given user,
+// lists and maps are stored as json
+func userValues(user User) ([]any, error) {
+	roles, err := json.Marshal(nonNil(user.Roles))
+	if err != nil {
+		return nil, err
+	}
+	scopes, err := json.Marshal(nonNil(user.Scopes))
+	if err != nil {
+		return nil, err
+	}
+	recoveryCodes, err := json.Marshal(nonNil(user.RecoveryCodes))
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := json.Marshal(user.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if user.Credentials == nil {
+		credentials = []byte("[]")
+	}
+	attributes := []byte("{}")
+	if user.Attributes != nil {
+		if attributes, err = json.Marshal(user.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return []any{[]byte(user.Password), string(roles), string(scopes), string(attributes),
+		user.TOTPSecret, user.TOTPConfirmed, user.TOTPLastStep, string(recoveryCodes), string(credentials),
+		user.Email, user.EmailVerified}, nil
+}
+
+// scanUser reads a user selected with userSelect
+func scanUser(row interface{ Scan(dest ...any) error }) (*User, error) {
+	var user User
+	var password []byte
+	var roles, scopes, attributes, recoveryCodes, credentials string
+	if err := row.Scan(&user.Login, &password, &roles, &scopes, &attributes,
+		&user.TOTPSecret, &user.TOTPConfirmed, &user.TOTPLastStep, &recoveryCodes, &credentials,
+		&user.Email, &user.EmailVerified); err != nil {
+		return nil, err
+	}
+	user.Password = string(password)
+	if err := unmarshalList(roles, &user.Roles); err != nil {
+		return nil, fmt.Errorf("invalid roles of %s: %w", user.Login, err)
+	}
+	if err := unmarshalList(scopes, &user.Scopes); err != nil {
+		return nil, fmt.Errorf("invalid scopes of %s: %w", user.Login, err)
+	}
+	if err := unmarshalList(recoveryCodes, &user.RecoveryCodes); err != nil {
+		return nil, fmt.Errorf("invalid recovery codes of %s: %w", user.Login, err)
+	}
+	if err := json.Unmarshal([]byte(credentials), &user.Credentials); err != nil {
+		return nil, fmt.Errorf("invalid credentials of %s: %w", user.Login, err)
+	}
+	if len(user.Credentials) == 0 {
+		user.Credentials = nil
+	}
+	if err := json.Unmarshal([]byte(attributes), &user.Attributes); err != nil {
+		return nil, fmt.Errorf("invalid attributes of %s: %w", user.Login, err)
+	}
+	if len(user.Attributes) == 0 {
+		user.Attributes = nil
+	}
+	return &user, nil
+}
+
+// unmarshalList decodes a json array, an empty one is decoded to nil
+func unmarshalList(data string, list *[]string) error {
+	if err := json.Unmarshal([]byte(data), list); err != nil {
+		return err
+	}
+	if len(*list) == 0 {
+		*list = nil
+	}
+	return nil
+}
+
+// nonNil returns an empty slice for nil, so it's stored as `[]` rather than `null`
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
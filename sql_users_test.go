@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLUsers(t *testing.T) *SQLUsers {
+	up, err := NewSQLUsers(filepath.Join(t.TempDir(), "auth.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { up.Close() })
+
+	_, err = up.Migrate()
+	assert.NoError(t, err)
+	return up
+}
+
+func TestSQLUsersMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.db")
+	up, err := NewSQLUsers(path)
+	assert.NoError(t, err)
+
+	current, latest, err := up.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, current)
+	assert.Equal(t, len(sqlMigrations), latest)
+
+	applied, err := up.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, len(sqlMigrations), applied)
+
+	// nothing left to apply
+	applied, err = up.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+	assert.NoError(t, up.Close())
+
+	// schema version survives reopening
+	up, err = NewSQLUsers(path)
+	assert.NoError(t, err)
+	defer up.Close()
+	current, latest, err = up.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, latest, current)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	ErrTOTPNotEnrolled = "totp is not enrolled"
+	ErrTOTPEnrolled    = "totp is already enrolled"
+	ErrTOTPInvalidCode = "invalid totp code"
+	ErrMFATokenInvalid = "invalid mfa token"
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew is the number of steps before and after the current one accepted
+	totpSkew = 1
+	// mfaPurpose marks tokens good for VerifyMFA only
+	mfaPurpose = "mfa"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is a pending TOTP secret, it's enabled once confirmed with a first code
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	// URI is an otpauth:// URI for authenticator apps, usually shown as a QR code
+	URI string `json:"uri"`
+}
+
+// MFARequiredError is returned by Signin for users with TOTP enabled,
+// the mfa token has to be exchanged for a session with VerifyMFA
+type MFARequiredError struct {
+	Token *Token
+}
+
+func (e *MFARequiredError) Error() string {
+	return "mfa required"
+}
+
+// totpCode computes an RFC 6238 code of a given time step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// isTOTPCode tells TOTP codes from recovery codes
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// matchTOTP returns the time step a code was issued for, steps next to
+// the current one are accepted to tolerate clock skew
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI builds a Key URI, https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpURI(issuer, login, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + login, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// QRCode - renders the enrollment URI as a PNG image
+func (e *TOTPEnrollment) QRCode(size int) ([]byte, error) {
+	return qrcode.Encode(e.URI, qrcode.Medium, size)
+}
+
+// EnrollTOTP - generates a TOTP secret for a user, it's stored as pending until
+// ConfirmTOTP, so an abandoned enrollment doesn't lock the user out
+func (s *AuthService) EnrollTOTP(login string) (*TOTPEnrollment, error) {
+	secret, err := randomBytes(20)
+	if err != nil {
+		return nil, err
+	}
+
+	enrolled := &User{Login: login, TOTPSecret: totpEncoding.EncodeToString(secret)}
+	err = s.Users.Modify(login, func(u *User) error {
+		if u.TOTPConfirmed {
+			return errors.New(ErrTOTPEnrolled)
+		}
+		u.TOTPSecret = enrolled.TOTPSecret
+		u.TOTPLastStep = 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.totpEnrollment(enrolled), nil
+}
+
+// PendingTOTP - returns an enrollment not confirmed yet, e.g. to render its QR code again
+func (s *AuthService) PendingTOTP(login string) (*TOTPEnrollment, error) {
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPSecret == "" || user.TOTPConfirmed {
+		return nil, errors.New(ErrTOTPNotEnrolled)
+	}
+	return s.totpEnrollment(user), nil
+}
+
+func (s *AuthService) totpEnrollment(user *User) *TOTPEnrollment {
+	return &TOTPEnrollment{Secret: user.TOTPSecret, URI: totpURI(s.Realm, user.Login, user.TOTPSecret)}
+}
+
+// ConfirmTOTP - enables a pending TOTP secret with a first code, signin requires
+// a code from now on. Returns recovery codes to show the user once, each of them
+// can be used instead of a TOTP code one time
+func (s *AuthService) ConfirmTOTP(login, code string) ([]string, error) {
+	confirm := func(u *User) error {
+		if u.TOTPSecret == "" {
+			return errors.New(ErrTOTPNotEnrolled)
+		}
+		if u.TOTPConfirmed {
+			return errors.New(ErrTOTPEnrolled)
+		}
+		return useTOTP(u, code)
+	}
+	// the code is checked before recovery codes are hashed, and again with the
+	// user locked, hashing is too slow to do it locked
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, err
+	}
+	if err := confirm(user); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := s.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Users.Modify(login, func(u *User) error {
+		if err := confirm(u); err != nil {
+			return err
+		}
+		u.TOTPConfirmed = true
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP - removes the TOTP secret and recovery codes of a user, signin becomes single-factor again
+func (s *AuthService) DisableTOTP(login string) error {
+	return s.updateUser(login, func(u *User) bool {
+		changed := u.TOTPSecret != "" || len(u.RecoveryCodes) > 0
+		u.TOTPSecret, u.TOTPConfirmed, u.TOTPLastStep = "", false, 0
+		u.RecoveryCodes = nil
+		return changed
+	})
+}
+
+// useTOTP checks a code and remembers its time step, so neither the code nor
+// an older one can be used again. It's a change for Users.Modify, so
+// concurrent requests can't use the same code
+func useTOTP(u *User, code string) error {
+	step, ok := matchTOTP(u.TOTPSecret, code, time.Now())
+	if !ok || step <= u.TOTPLastStep {
+		return errors.New(ErrTOTPInvalidCode)
+	}
+	u.TOTPLastStep = step
+	return nil
+}
+
+// newMFAToken issues a short-lived token good for VerifyMFA only
+func (s *AuthService) newMFAToken(user *User) (*Token, error) {
+	return s.Tokens.New(user.Login, WithPurpose(mfaPurpose), WithExpiresAt(time.Now().Add(s.MFATokenTTL)))
+}
+
+// VerifyMFA - exchanges an mfa token returned by SigninSession and a TOTP code
+// or a recovery code for a session
+func (s *AuthService) VerifyMFA(mfaToken, code string) (*Session, error) {
+	return s.VerifyMFAFrom("", mfaToken, code)
+}
+
+// VerifyMFAFrom - VerifyMFA of a client with a given IP, which may be empty. Wrong codes
+// count as failed signins of the login, and the mfa token stops working after MFAMaxAttempts of them
+func (s *AuthService) VerifyMFAFrom(ip, mfaToken, code string) (*Session, error) {
+	validated, err := s.Tokens.Validate(mfaToken)
+	if err != nil || validated.Purpose != mfaPurpose || s.spent.used(validated.ID) {
+		return nil, errors.New(ErrMFATokenInvalid)
+	}
+	if s.Lockout != nil {
+		if err := s.Lockout.Check(validated.Login, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := s.Users.Get(validated.Login)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPConfirmed {
+		return nil, errors.New(ErrTOTPNotEnrolled)
+	}
+	if isTOTPCode(code) {
+		err = s.Users.Modify(user.Login, func(u *User) error {
+			return useTOTP(u, code)
+		})
+	} else {
+		err = s.useRecoveryCode(user, code)
+	}
+	if err != nil {
+		if err.Error() == ErrTOTPInvalidCode || err.Error() == ErrRecoveryCodeInvalid {
+			s.signinFailed(user.Login, ip)
+			if s.mfaFailures.fail(validated.ID, validated.ExpiresAt) >= s.MFAMaxAttempts {
+				s.spendMFAToken(mfaToken, validated)
+			}
+		}
+		return nil, err
+	}
+
+	// the mfa token is done with
+	s.spendMFAToken(mfaToken, validated)
+	if s.Lockout != nil {
+		if err := s.Lockout.Unlock(user.Login); err != nil {
+			log.Printf("[WARN] failed to reset failed signins of %s, %v", user.Login, err)
+		}
+	}
+	return s.newSession(user)
+}
+
+// spendMFAToken makes an mfa token unusable, other instances sharing
+// the revocation store won't accept it either
+func (s *AuthService) spendMFAToken(mfaToken string, validated *Token) {
+	s.spent.spend(validated.ID, validated.ExpiresAt)
+	if err := s.RevokeToken(mfaToken); err != nil {
+		log.Printf("[DEBUG] failed to revoke mfa token of %s, %v", validated.Login, err)
+	}
+}
+
+// tokenFailures counts wrong codes per token id until the tokens expire
+type tokenFailures struct {
+	mu     sync.Mutex
+	counts map[string]tokenFailureCount
+}
+
+type tokenFailureCount struct {
+	n         int
+	expiresAt time.Time
+}
+
+// fail counts a wrong code of a token id, returns the number of wrong codes so far
+func (f *tokenFailures) fail(id string, expiresAt time.Time) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if f.counts == nil {
+		f.counts = map[string]tokenFailureCount{}
+	}
+	for k, c := range f.counts {
+		if now.After(c.expiresAt) {
+			delete(f.counts, k)
+		}
+	}
+	c := f.counts[id]
+	c.n++
+	c.expiresAt = expiresAt
+	f.counts[id] = c
+	return c.n
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 vectors truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	for ts, code := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		assert.Equal(t, code, totpCode(secret, totpStep(time.Unix(ts, 0))), "time %d", ts)
+	}
+
+	encoded := totpEncoding.EncodeToString(secret)
+	now := time.Unix(1111111111, 0)
+	step, ok := matchTOTP(encoded, "050471", now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// codes of the neighbour steps are accepted, older ones aren't
+	_, ok = matchTOTP(encoded, totpCode(secret, totpStep(now)+1), now)
+	assert.True(t, ok)
+	_, ok = matchTOTP(encoded, totpCode(secret, totpStep(now)-2), now)
+	assert.False(t, ok)
+	_, ok = matchTOTP(encoded, "50471", now)
+	assert.False(t, ok)
+}
+
+// currentTOTP returns a code of the current step shifted by a given number of steps
+func currentTOTP(t *testing.T, secret string, shift int64) string {
+	key, err := totpEncoding.DecodeString(secret)
+	assert.NoError(t, err)
+	return totpCode(key, totpStep(time.Now())+shift)
+}
+
+func TestTOTPSignin(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"), Revocations(NewMemoryRevocations()))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+
+	enrollment, err := service.EnrollTOTP("user1")
+	assert.NoError(t, err)
+	uri, err := url.Parse(enrollment.URI)
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/auth:user1", uri.Path)
+	assert.Equal(t, enrollment.Secret, uri.Query().Get("secret"))
+	assert.Equal(t, "auth", uri.Query().Get("issuer"))
+
+	png, err := enrollment.QRCode(256)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(png, []byte("\x89PNG")))
+
+	// pending enrollment doesn't change signin
+	_, err = service.Signin("user1", "password1")
+	assert.NoError(t, err)
+
+	_, err = service.ConfirmTOTP("user1", "000000x")
+	assert.EqualError(t, err, ErrTOTPInvalidCode)
+	// codes are captured once, the time step may change while the test runs
+	confirmation, next := currentTOTP(t, enrollment.Secret, 0), currentTOTP(t, enrollment.Secret, 1)
+	codes, err := service.ConfirmTOTP("user1", confirmation)
+	assert.NoError(t, err)
+	assert.Len(t, codes, 10)
+	_, err = service.ConfirmTOTP("user1", currentTOTP(t, enrollment.Secret, 0))
+	assert.EqualError(t, err, ErrTOTPEnrolled)
+	_, err = service.EnrollTOTP("user1")
+	assert.EqualError(t, err, ErrTOTPEnrolled)
+
+	// signin becomes two steps
+	_, err = service.Signin("user1", "password1")
+	var mfaRequired *MFARequiredError
+	assert.True(t, errors.As(err, &mfaRequired))
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	assert.Nil(t, session.Access)
+	assert.Nil(t, session.Refresh)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), session.MFA.ExpiresAt, 2*time.Second)
+
+	// the mfa token isn't an access token and can't be refreshed into one
+	_, err = service.Authenticate(session.MFA.Token)
+	assert.EqualError(t, err, ErrTokenPurpose)
+	_, err = tp.Refresh(session.MFA.Token)
+	assert.EqualError(t, err, ErrTokenPurpose)
+
+	// the code used for confirmation can't be replayed
+	_, err = service.VerifyMFA(session.MFA.Token, confirmation)
+	assert.EqualError(t, err, ErrTOTPInvalidCode)
+
+	full, err := service.VerifyMFA(session.MFA.Token, next)
+	assert.NoError(t, err)
+	p, err := service.Authenticate(full.Access.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", p.Login)
+	assert.NotNil(t, full.Refresh)
+
+	// neither the code nor the mfa token can be used again
+	session, err = service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	_, err = service.VerifyMFA(session.MFA.Token, next)
+	assert.EqualError(t, err, ErrTOTPInvalidCode)
+	_, err = service.VerifyMFA(full.Access.Token, next)
+	assert.EqualError(t, err, ErrMFATokenInvalid)
+
+	assert.NoError(t, service.DisableTOTP("user1"))
+	_, err = service.Signin("user1", "password1")
+	assert.NoError(t, err)
+}
+
+func TestMFAGuessing(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	lockout := NewLockout(NewMemoryLockoutStore())
+	lockout.FreeFailures, lockout.MaxFailures = 100, 8
+	service := NewAuthService(tp, NewUsers(), Lockouts(lockout))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	enrollment, err := service.EnrollTOTP("user1")
+	assert.NoError(t, err)
+	_, err = service.ConfirmTOTP("user1", currentTOTP(t, enrollment.Secret, 0))
+	assert.NoError(t, err)
+	// a code of a time step long gone is never valid
+	wrong := currentTOTP(t, enrollment.Secret, -10)
+
+	// the mfa token stops working after a few wrong codes, even with the right one
+	session, err := service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	for i := 0; i < service.MFAMaxAttempts; i++ {
+		_, err = service.VerifyMFA(session.MFA.Token, wrong)
+		assert.EqualError(t, err, ErrTOTPInvalidCode)
+	}
+	_, err = service.VerifyMFA(session.MFA.Token, currentTOTP(t, enrollment.Secret, 1))
+	assert.EqualError(t, err, ErrMFATokenInvalid)
+
+	// wrong codes of fresh mfa tokens add up to a lockout of the login,
+	// the right password doesn't reset the count
+	session, err = service.SigninSession("user1", "password1")
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = service.VerifyMFA(session.MFA.Token, wrong)
+		assert.EqualError(t, err, ErrTOTPInvalidCode)
+	}
+	_, err = service.VerifyMFA(session.MFA.Token, currentTOTP(t, enrollment.Secret, 1))
+	var locked *LockedError
+	assert.True(t, errors.As(err, &locked))
+	_, err = service.SigninSession("user1", "password1")
+	assert.True(t, errors.As(err, &locked))
+}
+
+func TestTOTPHandlers(t *testing.T) {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers())
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	token, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/auth/mfa/totp/enroll", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/auth/mfa/totp/qr", token, "").Code)
+
+	response := do("POST", "/auth/mfa/totp/enroll", token, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	var enrollment TOTPEnrollment
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&enrollment))
+	assert.NotEmpty(t, enrollment.Secret)
+
+	response = do("GET", "/auth/mfa/totp/qr", token, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "image/png", response.Header().Get("Content-Type"))
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/auth/mfa/totp/confirm", token, `{"code": "000000x"}`).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/auth/mfa/totp/confirm", token, `{"code": "`+currentTOTP(t, enrollment.Secret, 0)+`"}`).Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/auth/mfa/totp/enroll", token, "").Code)
+
+	response = do("POST", "/auth/signin", "", `{"login": "user1", "password": "password1"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Result().Cookies())
+	var pending map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&pending))
+	assert.Equal(t, "MFA_REQUIRED", pending["status"])
+
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/auth/mfa/verify", "", `{"mfa_token": "`+pending["mfa_token"]+`", "code": "abcdef"}`).Code)
+	response = do("POST", "/auth/mfa/verify", "", `{"mfa_token": "`+pending["mfa_token"]+`", "code": "`+currentTOTP(t, enrollment.Secret, 1)+`"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	assert.Equal(t, "OK", session["status"])
+	login, err := service.Check(session["token"])
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+}
@@ -1,8 +1,16 @@
 package main
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
 
 type Users struct {
+	mu    sync.RWMutex
 	Users map[string]User
 }
 
@@ -12,18 +20,75 @@ func NewUsers() *Users {
 }
 
 func (u *Users) Get(login string) (*User, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
 	user, ok := u.Users[login]
 	if !ok {
 		return nil, errors.New(ErrUserNotFound)
 	}
+	user = user.clone()
 	return &user, nil
 }
 
 func (u *Users) Create(user User) error {
-	u.Users[user.Login] = user
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.Users[user.Login]; ok {
+		return &UserExistsError{Login: user.Login}
+	}
+	u.Users[user.Login] = user.clone()
+	return nil
+}
+
+func (u *Users) Update(user User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.Users[user.Login]; !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	u.Users[user.Login] = user.clone()
+	return nil
+}
+
+func (u *Users) Modify(login string, change func(*User) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	user, ok := u.Users[login]
+	if !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	user = user.clone()
+	if err := change(&user); err != nil {
+		return err
+	}
+	u.Users[login] = user
+	return nil
+}
+
+func (u *Users) Delete(login string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.Users[login]; !ok {
+		return errors.New(ErrUserNotFound)
+	}
+	delete(u.Users, login)
 	return nil
 }
 
+func (u *Users) List(offset, limit int) ([]User, int, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	users, total := paginate(u.Users, offset, limit)
+	return users, total, nil
+}
+
+func (u *Users) Exists(login string) (bool, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	_, ok := u.Users[login]
+	return ok, nil
+}
+
 type StaticUsers struct {
 	Users map[string]User
 }
@@ -37,9 +102,82 @@ func (u *StaticUsers) Get(login string) (*User, error) {
 	if !ok {
 		return nil, errors.New(ErrUserNotFound)
 	}
+	user = user.clone()
 	return &user, nil
 }
 
 func (u *StaticUsers) Create(user User) error {
-	return errors.New("read-only user provider")
+	return errors.New(ErrReadOnly)
+}
+
+func (u *StaticUsers) Update(user User) error {
+	return errors.New(ErrReadOnly)
+}
+
+func (u *StaticUsers) Modify(login string, change func(*User) error) error {
+	user, err := u.Get(login)
+	if err != nil {
+		return err
+	}
+	// a failed change is reported as with other providers
+	if err := change(user); err != nil {
+		return err
+	}
+	return errors.New(ErrReadOnly)
+}
+
+func (u *StaticUsers) Delete(login string) error {
+	return errors.New(ErrReadOnly)
+}
+
+func (u *StaticUsers) List(offset, limit int) ([]User, int, error) {
+	users, total := paginate(u.Users, offset, limit)
+	return users, total, nil
+}
+
+func (u *StaticUsers) Exists(login string) (bool, error) {
+	_, ok := u.Users[login]
+	return ok, nil
+}
+
+// paginate returns a page of users sorted by login and the total number of users,
+// non-positive limit means no limit
+func paginate(users map[string]User, offset, limit int) ([]User, int) {
+	logins := make([]string, 0, len(users))
+	for login := range users {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(logins) {
+		offset = len(logins)
+	}
+	end := len(logins)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+
+	page := make([]User, 0, end-offset)
+	for _, login := range logins[offset:end] {
+		page = append(page, users[login].clone())
+	}
+	return page, len(logins)
+}
+
+// clone returns a deep copy of a user. The in-memory stores keep and hand out
+// copies, so a change to a user read from them stays local until Update
+func (u User) clone() User {
+	u.Roles = slices.Clone(u.Roles)
+	u.Scopes = slices.Clone(u.Scopes)
+	u.Attributes = maps.Clone(u.Attributes)
+	u.RecoveryCodes = slices.Clone(u.RecoveryCodes)
+	u.Credentials = slices.Clone(u.Credentials)
+	for i, c := range u.Credentials {
+		u.Credentials[i].ID = bytes.Clone(c.ID)
+		u.Credentials[i].PublicKey = bytes.Clone(c.PublicKey)
+	}
+	return u
 }
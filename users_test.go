@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testUserProviders returns an empty store of every writable kind.
+func testUserProviders(t *testing.T) map[string]UserProvider {
+	fileUsers, err := NewFileUsers(filepath.Join(t.TempDir(), "users.json"))
+	assert.NoError(t, err)
+
+	return map[string]UserProvider{
+		"memory": NewUsers(),
+		"file":   fileUsers,
+		"sqlite": newTestSQLUsers(t),
+	}
+}
+
+func TestUserProviders(t *testing.T) {
+	for name, up := range testUserProviders(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, up.Create(User{Login: "user2", Password: "hash2"}))
+			assert.NoError(t, up.Create(User{Login: "user1", Password: "hash1"}))
+			assert.NoError(t, up.Create(User{Login: "user3", Password: "hash3"}))
+
+			// duplicate login doesn't overwrite the user
+			err := up.Create(User{Login: "user1", Password: "hijacked"})
+			var exists *UserExistsError
+			assert.True(t, errors.As(err, &exists))
+			assert.Equal(t, "user1", exists.Login)
+			user, err := up.Get("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, "hash1", user.Password)
+
+			ok, err := up.Exists("user1")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = up.Exists("unknown")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			assert.NoError(t, up.Update(User{Login: "user1", Password: "new hash"}))
+			user, err = up.Get("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, "new hash", user.Password)
+			assert.EqualError(t, up.Update(User{Login: "unknown"}), ErrUserNotFound)
+
+			assert.NoError(t, up.Update(User{Login: "user1", Password: "new hash",
+				Roles: []string{"admin", "editor"}, Scopes: []string{"orders:*"}, Attributes: map[string]string{"org": "acme"},
+				TOTPSecret: "SECRET", TOTPConfirmed: true, TOTPLastStep: 42, RecoveryCodes: []string{"hash"},
+				Credentials: []WebAuthnCredential{{ID: []byte{1}, PublicKey: []byte{2}, SignCount: 3}},
+				Email:       "user1@example.com", EmailVerified: true}))
+			user, err = up.Get("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"admin", "editor"}, user.Roles)
+			assert.Equal(t, []string{"orders:*"}, user.Scopes)
+			assert.Equal(t, map[string]string{"org": "acme"}, user.Attributes)
+			assert.Equal(t, "SECRET", user.TOTPSecret)
+			assert.True(t, user.TOTPConfirmed)
+			assert.Equal(t, int64(42), user.TOTPLastStep)
+			assert.Equal(t, []string{"hash"}, user.RecoveryCodes)
+			assert.Len(t, user.Credentials, 1)
+			assert.Equal(t, uint32(3), user.Credentials[0].SignCount)
+			assert.Equal(t, "user1@example.com", user.Email)
+			assert.True(t, user.EmailVerified)
+
+			// returned users don't share their slices and maps with the store
+			user.Roles[0], user.Attributes["org"], user.RecoveryCodes[0] = "root", "evil", "other"
+			user.Credentials[0].SignCount = 100
+			user, err = up.Get("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"admin", "editor"}, user.Roles)
+			assert.Equal(t, map[string]string{"org": "acme"}, user.Attributes)
+			assert.Equal(t, []string{"hash"}, user.RecoveryCodes)
+			assert.Equal(t, uint32(3), user.Credentials[0].SignCount)
+
+			users, total, err := up.List(0, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, total)
+			assert.Equal(t, []string{"user1", "user2"}, logins(users))
+
+			users, total, err = up.List(2, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, total)
+			assert.Equal(t, []string{"user3"}, logins(users))
+
+			users, _, err = up.List(5, 2)
+			assert.NoError(t, err)
+			assert.Empty(t, users)
+
+			users, _, err = up.List(0, 0)
+			assert.NoError(t, err)
+			assert.Len(t, users, 3)
+
+			assert.NoError(t, up.Delete("user2"))
+			assert.EqualError(t, up.Delete("user2"), ErrUserNotFound)
+			_, err = up.Get("user2")
+			assert.EqualError(t, err, ErrUserNotFound)
+		})
+	}
+}
+
+func TestUsersConcurrentCreate(t *testing.T) {
+	up := NewUsers()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// every user is created twice, only one attempt succeeds
+			if up.Create(User{Login: fmt.Sprintf("user%d", i%25)}) == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	_, total, err := up.List(0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 25, total)
+	assert.Equal(t, 25, created)
+}
+
+func TestUsersConcurrentModify(t *testing.T) {
+	for name, up := range testUserProviders(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, up.Create(User{Login: "user1", Password: "hash1"}))
+
+			// every change lands, none of them overwrites another
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					assert.NoError(t, up.Modify("user1", func(u *User) error {
+						u.Roles = append(u.Roles, fmt.Sprintf("role%d", i))
+						return nil
+					}))
+				}(i)
+			}
+			wg.Wait()
+
+			user, err := up.Get("user1")
+			assert.NoError(t, err)
+			assert.Len(t, user.Roles, 20)
+
+			// a failed change isn't stored
+			err = up.Modify("user1", func(u *User) error {
+				u.Roles = nil
+				return errors.New("failed")
+			})
+			assert.EqualError(t, err, "failed")
+			user, err = up.Get("user1")
+			assert.NoError(t, err)
+			assert.Len(t, user.Roles, 20)
+
+			err = up.Modify("unknown", func(u *User) error { return nil })
+			assert.EqualError(t, err, ErrUserNotFound)
+		})
+	}
+}
+
+func TestStaticUsersReadOnly(t *testing.T) {
+	up := NewStaticUsers(map[string]User{"user1": {Login: "user1"}, "user2": {Login: "user2"}})
+
+	assert.EqualError(t, up.Create(User{Login: "user3"}), ErrReadOnly)
+	assert.EqualError(t, up.Update(User{Login: "user1"}), ErrReadOnly)
+	assert.EqualError(t, up.Modify("user1", func(u *User) error { return nil }), ErrReadOnly)
+	assert.EqualError(t, up.Delete("user1"), ErrReadOnly)
+
+	ok, err := up.Exists("user1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	users, total, err := up.List(1, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []string{"user2"}, logins(users))
+}
+
+func logins(users []User) []string {
+	res := make([]string, 0, len(users))
+	for _, u := range users {
+		res = append(res, u.Login)
+	}
+	return res
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrWebAuthnNotConfigured = "webauthn is not configured"
+	ErrWebAuthnChallenge     = "unknown or expired webauthn challenge"
+	ErrCredentialNotFound    = "credential not found"
+	ErrCredentialExists      = "credential already registered"
+	ErrSignCount             = "sign counter didn't increase, the authenticator may be cloned"
+)
+
+// COSE algorithms of supported credential keys
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+)
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	ID []byte `json:"id"`
+	// PublicKey is the credential public key as a COSE_Key
+	PublicKey  []byte    `json:"public_key"`
+	SignCount  uint32    `json:"sign_count"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthn is a relying party, it runs registration and login ceremonies
+// of passkeys. Attestation statements aren't verified, which is the same as
+// requesting `none` attestation conveyance
+type WebAuthn struct {
+	// RPID is the relying party id, a domain like example.com
+	RPID   string
+	RPName string
+	// Origins are origins ceremonies are accepted from, like https://example.com
+	Origins []string
+	// Timeout is the time to complete a ceremony
+	Timeout time.Duration
+
+	mu         sync.Mutex
+	challenges map[string]webauthnChallenge
+}
+
+// webauthnChallenge is a pending ceremony, login is empty for usernameless login
+type webauthnChallenge struct {
+	login     string
+	ceremony  string
+	expiresAt time.Time
+}
+
+func NewWebAuthn(rpID, rpName string, origins ...string) *WebAuthn {
+	return &WebAuthn{
+		RPID:       rpID,
+		RPName:     rpName,
+		Origins:    origins,
+		Timeout:    5 * time.Minute,
+		challenges: map[string]webauthnChallenge{},
+	}
+}
+
+// base64URL is binary data encoded as unpadded base64url in json,
+// the way WebAuthn JSON serializes binary fields
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// CredentialCreationOptions are passed to navigator.credentials.create()
+type CredentialCreationOptions struct {
+	PublicKey struct {
+		Challenge base64URL `json:"challenge"`
+		RP        struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"rp"`
+		User struct {
+			ID          base64URL `json:"id"`
+			Name        string    `json:"name"`
+			DisplayName string    `json:"displayName"`
+		} `json:"user"`
+		PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		Attestation            string                 `json:"attestation"`
+		ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection struct {
+			ResidentKey      string `json:"residentKey"`
+			UserVerification string `json:"userVerification"`
+		} `json:"authenticatorSelection"`
+	} `json:"publicKey"`
+}
+
+// CredentialRequestOptions are passed to navigator.credentials.get()
+type CredentialRequestOptions struct {
+	PublicKey struct {
+		Challenge        base64URL              `json:"challenge"`
+		RPID             string                 `json:"rpId"`
+		Timeout          int64                  `json:"timeout"`
+		AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+		UserVerification string                 `json:"userVerification"`
+	} `json:"publicKey"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   base64URL `json:"id"`
+}
+
+// RegistrationResponse is the json of a credential returned by navigator.credentials.create()
+type RegistrationResponse struct {
+	ID       string    `json:"id"`
+	RawID    base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AttestationObject base64URL `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the json of a credential returned by navigator.credentials.get()
+type AssertionResponse struct {
+	ID       string    `json:"id"`
+	RawID    base64URL `json:"rawId"`
+	Type     string    `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AuthenticatorData base64URL `json:"authenticatorData"`
+		Signature         base64URL `json:"signature"`
+		UserHandle        base64URL `json:"userHandle"`
+	} `json:"response"`
+}
+
+// clientData is the part of CollectedClientData checked by the relying party
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticatorData is parsed authenticator data, credential fields are set on registration only
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// newChallenge starts a ceremony
+func (w *WebAuthn) newChallenge(login, ceremony string) ([]byte, error) {
+	challenge, err := randomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for k, c := range w.challenges {
+		if now.After(c.expiresAt) {
+			delete(w.challenges, k)
+		}
+	}
+	w.challenges[base64.RawURLEncoding.EncodeToString(challenge)] = webauthnChallenge{
+		login: login, ceremony: ceremony, expiresAt: now.Add(w.Timeout),
+	}
+	return challenge, nil
+}
+
+// verifyClientData checks client data of a ceremony and takes its challenge,
+// so it can't be used again. Returns the login the ceremony was started for
+func (w *WebAuthn) verifyClientData(raw []byte, ceremony string) (string, error) {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", fmt.Errorf("invalid client data: %w", err)
+	}
+	if cd.Type != ceremony {
+		return "", fmt.Errorf("unexpected client data type %q", cd.Type)
+	}
+
+	originAllowed := false
+	for _, origin := range w.Origins {
+		originAllowed = originAllowed || cd.Origin == origin
+	}
+	if !originAllowed {
+		return "", fmt.Errorf("unexpected origin %q", cd.Origin)
+	}
+
+	w.mu.Lock()
+	c, ok := w.challenges[cd.Challenge]
+	delete(w.challenges, cd.Challenge)
+	w.mu.Unlock()
+	if !ok || c.ceremony != ceremony || time.Now().After(c.expiresAt) {
+		return "", errors.New(ErrWebAuthnChallenge)
+	}
+	return c.login, nil
+}
+
+// parseAuthenticatorData parses authenticator data and checks it's made for the relying party
+// by a present user, https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+func (w *WebAuthn) parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	ad := &authenticatorData{rpIDHash: data[:32], flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+
+	rpIDHash := sha256.Sum256([]byte(w.RPID))
+	if !bytes.Equal(ad.rpIDHash, rpIDHash[:]) {
+		return nil, errors.New("authenticator data is made for another relying party")
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, errors.New("user is not present")
+	}
+
+	if ad.flags&flagAttestedData != 0 {
+		// aaguid (16), credential id length (2), credential id, COSE key
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return nil, errors.New("attested credential data is too short")
+		}
+		ad.credentialID = rest[:n]
+		key, after, err := decodeCBOR(rest[n:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		if _, ok := key.(map[any]any); !ok {
+			return nil, errors.New("invalid credential public key")
+		}
+		ad.publicKey = rest[n : len(rest)-len(after)]
+	}
+	return ad, nil
+}
+
+// parseCOSEKey parses a COSE_Key, ES256 and EdDSA keys are supported
+func parseCOSEKey(coseKey []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.New("invalid COSE key")
+	}
+	// COSE key parameters, RFC 9053: 3 alg, -1 crv, -2 x, -3 y
+	alg, _ := key[int64(3)].(int64)
+	crv, _ := key[int64(-1)].(int64)
+	x, _ := key[int64(-2)].([]byte)
+
+	switch alg {
+	case coseES256:
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid ES256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid ES256 key")
+		}
+		return pub, nil
+	case coseEdDSA:
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid EdDSA key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported COSE algorithm %d", alg)
+}
+
+// verifyCOSESignature checks a signature made by the private key of a COSE_Key
+func verifyCOSESignature(coseKey, signed, sig []byte) error {
+	pub, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	valid := false
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		valid = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, signed, sig)
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// webAuthnUserID is the user handle of a login, authenticators return it on usernameless login
+func webAuthnUserID(login string) []byte {
+	return []byte(login)
+}
+
+func (s *AuthService) webAuthn() (*WebAuthn, error) {
+	if s.WebAuthn == nil {
+		return nil, errors.New(ErrWebAuthnNotConfigured)
+	}
+	return s.WebAuthn, nil
+}
+
+// BeginPasskeyRegistration - starts registration of a passkey for a signed in user,
+// returns options for navigator.credentials.create()
+func (s *AuthService) BeginPasskeyRegistration(login string) (*CredentialCreationOptions, error) {
+	w, err := s.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, err
+	}
+	challenge, err := w.newChallenge(login, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &CredentialCreationOptions{}
+	pk := &opts.PublicKey
+	pk.Challenge = challenge
+	pk.RP.ID, pk.RP.Name = w.RPID, w.RPName
+	pk.User.ID, pk.User.Name, pk.User.DisplayName = webAuthnUserID(login), login, login
+	pk.PubKeyCredParams = []credentialParameter{{"public-key", coseES256}, {"public-key", coseEdDSA}}
+	pk.Timeout = w.Timeout.Milliseconds()
+	pk.Attestation = "none"
+	pk.ExcludeCredentials = credentialDescriptors(user.Credentials)
+	pk.AuthenticatorSelection.ResidentKey = "preferred"
+	pk.AuthenticatorSelection.UserVerification = "preferred"
+	return opts, nil
+}
+
+// FinishPasskeyRegistration - verifies a credential created by the authenticator
+// and stores it for the user the registration was started for
+func (s *AuthService) FinishPasskeyRegistration(login string, resp RegistrationResponse) (*WebAuthnCredential, error) {
+	w, err := s.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+	started, err := w.verifyClientData(resp.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+	if started != login {
+		return nil, errors.New(ErrWebAuthnChallenge)
+	}
+
+	decoded, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	attestation, _ := decoded.(map[any]any)
+	rawAuthData, _ := attestation["authData"].([]byte)
+	ad, err := w.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("no attested credential data")
+	}
+	// the key is checked to be usable before it's stored
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+
+	cred := WebAuthnCredential{ID: ad.credentialID, PublicKey: ad.publicKey, SignCount: ad.signCount, CreatedAt: time.Now()}
+	err = s.Users.Modify(login, func(u *User) error {
+		for _, c := range u.Credentials {
+			if bytes.Equal(c.ID, cred.ID) {
+				return errors.New(ErrCredentialExists)
+			}
+		}
+		u.Credentials = append(u.Credentials, cred)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// BeginPasskeyLogin - starts passkey login, returns options for navigator.credentials.get().
+// With an empty login any discoverable credential of the relying party can be used
+func (s *AuthService) BeginPasskeyLogin(login string) (*CredentialRequestOptions, error) {
+	w, err := s.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []credentialDescriptor
+	if login != "" {
+		// unknown logins get options as well, not to reveal which logins exist
+		if user, err := s.Users.Get(login); err == nil {
+			allowed = credentialDescriptors(user.Credentials)
+		}
+	}
+	challenge, err := w.newChallenge(login, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &CredentialRequestOptions{}
+	pk := &opts.PublicKey
+	pk.Challenge = challenge
+	pk.RPID = w.RPID
+	pk.Timeout = w.Timeout.Milliseconds()
+	pk.AllowCredentials = allowed
+	pk.UserVerification = "preferred"
+	return opts, nil
+}
+
+// FinishPasskeyLogin - verifies an assertion of a registered credential and
+// issues a session, the same as a password signin does
+func (s *AuthService) FinishPasskeyLogin(resp AssertionResponse) (*Session, error) {
+	w, err := s.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+	login, err := w.verifyClientData(resp.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, err
+	}
+	if handle := string(resp.Response.UserHandle); handle != "" {
+		if login != "" && handle != login {
+			return nil, errors.New(ErrCredentialNotFound)
+		}
+		login = handle
+	}
+	if login == "" {
+		return nil, errors.New(ErrCredentialNotFound)
+	}
+
+	ad, err := w.parseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.Users.Get(login)
+	if err != nil {
+		return nil, errors.New(ErrCredentialNotFound)
+	}
+	cred := findCredential(user, resp.RawID)
+	if cred == nil {
+		return nil, errors.New(ErrCredentialNotFound)
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte{}, resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(cred.PublicKey, signed, resp.Response.Signature); err != nil {
+		return nil, err
+	}
+
+	// the counter is checked with the user locked, a replayed assertion may race the original
+	err = s.Users.Modify(login, func(u *User) error {
+		cred := findCredential(u, resp.RawID)
+		if cred == nil {
+			return errors.New(ErrCredentialNotFound)
+		}
+		// authenticators without a counter always report zero
+		if ad.signCount != 0 || cred.SignCount != 0 {
+			if ad.signCount <= cred.SignCount {
+				return errors.New(ErrSignCount)
+			}
+		}
+		cred.SignCount, cred.LastUsedAt = ad.signCount, time.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.newSession(user)
+}
+
+// findCredential returns a credential of a user by its ID, or nil
+func findCredential(user *User, id []byte) *WebAuthnCredential {
+	for i := range user.Credentials {
+		if bytes.Equal(user.Credentials[i].ID, id) {
+			return &user.Credentials[i]
+		}
+	}
+	return nil
+}
+
+func credentialDescriptors(creds []WebAuthnCredential) []credentialDescriptor {
+	descriptors := []credentialDescriptor{}
+	for _, c := range creds {
+		descriptors = append(descriptors, credentialDescriptor{Type: "public-key", ID: c.ID})
+	}
+	return descriptors
+}
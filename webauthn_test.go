@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// softAuthenticator is a software passkey authenticator, it makes
+// credentials and assertions the way a browser and a platform authenticator do
+type softAuthenticator struct {
+	origin     string
+	ecKey      *ecdsa.PrivateKey
+	edKey      ed25519.PrivateKey
+	credID     []byte
+	userHandle []byte
+	counter    uint32
+}
+
+func newSoftAuthenticator(t *testing.T, origin string, eddsa bool) *softAuthenticator {
+	a := &softAuthenticator{origin: origin, credID: make([]byte, 16)}
+	_, err := rand.Read(a.credID)
+	assert.NoError(t, err)
+	if eddsa {
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	assert.NoError(t, err)
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.edKey != nil {
+		return encodeCBOR(map[any]any{1: 1, 3: coseEdDSA, -1: 6, -2: []byte(a.edKey.Public().(ed25519.PublicKey))})
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	a.ecKey.X.FillBytes(x)
+	a.ecKey.Y.FillBytes(y)
+	return encodeCBOR(map[any]any{1: 2, 3: coseES256, -1: 1, -2: x, -3: y})
+}
+
+func (a *softAuthenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	return binary.BigEndian.AppendUint32(append(rpIDHash[:], flags), a.counter)
+}
+
+// create makes a credential, like navigator.credentials.create()
+func (a *softAuthenticator) create(opts *CredentialCreationOptions) RegistrationResponse {
+	a.userHandle = opts.PublicKey.User.ID
+	authData := a.authData(opts.PublicKey.RP.ID, flagUserPresent|flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // aaguid
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(append(authData, a.credID...), a.coseKey()...)
+
+	var resp RegistrationResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.credID)
+	resp.RawID = a.credID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = a.clientData("webauthn.create", opts.PublicKey.Challenge)
+	resp.Response.AttestationObject = encodeCBOR(map[any]any{"fmt": "none", "attStmt": map[any]any{}, "authData": authData})
+	return resp
+}
+
+// get makes an assertion, like navigator.credentials.get()
+func (a *softAuthenticator) get(opts *CredentialRequestOptions) AssertionResponse {
+	a.counter++
+	authData := a.authData(opts.PublicKey.RPID, flagUserPresent)
+	clientData := a.clientData("webauthn.get", opts.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	var sig []byte
+	if a.edKey != nil {
+		sig = ed25519.Sign(a.edKey, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		sig, _ = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	}
+
+	var resp AssertionResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(a.credID)
+	resp.RawID = a.credID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = sig
+	resp.Response.UserHandle = a.userHandle
+	return resp
+}
+
+func newPasskeyService(t *testing.T) *AuthService {
+	tp := NewJwtProvider(ExpirationTime(time.Minute), Key("my_secret_key"))
+	service := NewAuthService(tp, NewUsers(), Passkeys(NewWebAuthn("example.com", "Example", "https://example.com")))
+	_, err := service.Signup("user1", "password1")
+	assert.NoError(t, err)
+	assert.NoError(t, service.GrantRole("user1", "admin"))
+	return service
+}
+
+func registerPasskey(t *testing.T, service *AuthService, a *softAuthenticator) {
+	opts, err := service.BeginPasskeyRegistration("user1")
+	assert.NoError(t, err)
+	_, err = service.FinishPasskeyRegistration("user1", a.create(opts))
+	assert.NoError(t, err)
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	for name, eddsa := range map[string]bool{"ES256": false, "EdDSA": true} {
+		t.Run(name, func(t *testing.T) {
+			service := newPasskeyService(t)
+			a := newSoftAuthenticator(t, "https://example.com", eddsa)
+
+			opts, err := service.BeginPasskeyRegistration("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, "example.com", opts.PublicKey.RP.ID)
+			assert.Equal(t, []byte("user1"), []byte(opts.PublicKey.User.ID))
+			assert.Empty(t, opts.PublicKey.ExcludeCredentials)
+			cred, err := service.FinishPasskeyRegistration("user1", a.create(opts))
+			assert.NoError(t, err)
+			assert.Equal(t, a.credID, cred.ID)
+
+			user, err := service.Users.Get("user1")
+			assert.NoError(t, err)
+			assert.Len(t, user.Credentials, 1)
+
+			// the same credential can't be registered twice
+			opts, err = service.BeginPasskeyRegistration("user1")
+			assert.NoError(t, err)
+			assert.Len(t, opts.PublicKey.ExcludeCredentials, 1)
+			_, err = service.FinishPasskeyRegistration("user1", a.create(opts))
+			assert.EqualError(t, err, ErrCredentialExists)
+
+			loginOpts, err := service.BeginPasskeyLogin("user1")
+			assert.NoError(t, err)
+			assert.Len(t, loginOpts.PublicKey.AllowCredentials, 1)
+			assert.Equal(t, a.credID, []byte(loginOpts.PublicKey.AllowCredentials[0].ID))
+			session, err := service.FinishPasskeyLogin(a.get(loginOpts))
+			assert.NoError(t, err)
+
+			// tokens are the same as the ones of password signin
+			passkey, err := service.Authenticate(session.Access.Token)
+			assert.NoError(t, err)
+			password, err := service.SigninSession("user1", "password1")
+			assert.NoError(t, err)
+			expected, err := service.Authenticate(password.Access.Token)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.Login, passkey.Login)
+			assert.Equal(t, expected.Roles, passkey.Roles)
+			assert.NotNil(t, session.Refresh)
+
+			// usernameless login finds the user by the user handle
+			loginOpts, err = service.BeginPasskeyLogin("")
+			assert.NoError(t, err)
+			assert.Empty(t, loginOpts.PublicKey.AllowCredentials)
+			assertion := a.get(loginOpts)
+			_, err = service.FinishPasskeyLogin(assertion)
+			assert.NoError(t, err)
+
+			user, err = service.Users.Get("user1")
+			assert.NoError(t, err)
+			assert.Equal(t, uint32(2), user.Credentials[0].SignCount)
+
+			// challenges are single use
+			_, err = service.FinishPasskeyLogin(assertion)
+			assert.EqualError(t, err, ErrWebAuthnChallenge)
+		})
+	}
+}
+
+func TestPasskeyLoginRejects(t *testing.T) {
+	service := newPasskeyService(t)
+	a := newSoftAuthenticator(t, "https://example.com", false)
+	registerPasskey(t, service, a)
+
+	login := func(a *softAuthenticator, tamper func(*AssertionResponse)) error {
+		opts, err := service.BeginPasskeyLogin("user1")
+		assert.NoError(t, err)
+		resp := a.get(opts)
+		if tamper != nil {
+			tamper(&resp)
+		}
+		_, err = service.FinishPasskeyLogin(resp)
+		return err
+	}
+	assert.NoError(t, login(a, nil))
+
+	// a cloned authenticator is detected by its counter falling behind
+	clone := *a
+	assert.NoError(t, login(a, nil))
+	assert.EqualError(t, login(&clone, nil), ErrSignCount)
+
+	assert.Error(t, login(a, func(r *AssertionResponse) { r.Response.Signature[10] ^= 0xff }))
+	assert.Error(t, login(a, func(r *AssertionResponse) { r.Response.AuthenticatorData[32] &^= flagUserPresent }))
+	assert.EqualError(t, login(a, func(r *AssertionResponse) { r.RawID = []byte("unknown") }), ErrCredentialNotFound)
+	assert.EqualError(t, login(a, func(r *AssertionResponse) { r.Response.UserHandle = []byte("user2") }), ErrCredentialNotFound)
+
+	evil := *a
+	evil.origin = "https://evil.example.com"
+	assert.Error(t, login(&evil, nil))
+
+	// a credential made for another relying party
+	opts, err := service.BeginPasskeyLogin("user1")
+	assert.NoError(t, err)
+	opts.PublicKey.RPID = "evil.example.com"
+	_, err = service.FinishPasskeyLogin(a.get(opts))
+	assert.Error(t, err)
+
+	// registration challenges can't be used for login
+	regOpts, err := service.BeginPasskeyRegistration("user1")
+	assert.NoError(t, err)
+	loginOpts := &CredentialRequestOptions{}
+	loginOpts.PublicKey.Challenge, loginOpts.PublicKey.RPID = regOpts.PublicKey.Challenge, "example.com"
+	_, err = service.FinishPasskeyLogin(a.get(loginOpts))
+	assert.EqualError(t, err, ErrWebAuthnChallenge)
+
+	// registration is bound to the user it was started for
+	_, err = service.Signup("user2", "password2")
+	assert.NoError(t, err)
+	opts2, err := service.BeginPasskeyRegistration("user2")
+	assert.NoError(t, err)
+	_, err = service.FinishPasskeyRegistration("user1", newSoftAuthenticator(t, "https://example.com", false).create(opts2))
+	assert.EqualError(t, err, ErrWebAuthnChallenge)
+}
+
+func TestPasskeyHandlers(t *testing.T) {
+	service := newPasskeyService(t)
+	token, err := service.Signin("user1", "password1")
+	assert.NoError(t, err)
+	handler := service.Handlers("/auth")
+	a := newSoftAuthenticator(t, "https://example.com", false)
+
+	do := func(path, token string, body any) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, req)
+		return response
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/webauthn/register/begin", "", nil).Code)
+
+	response := do("/auth/webauthn/register/begin", token, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var creation CredentialCreationOptions
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&creation))
+	assert.Equal(t, http.StatusOK, do("/auth/webauthn/register/finish", token, a.create(&creation)).Code)
+
+	response = do("/auth/webauthn/login/begin", "", map[string]string{"login": "user1"})
+	assert.Equal(t, http.StatusOK, response.Code)
+	var request CredentialRequestOptions
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&request))
+	assertion := a.get(&request)
+
+	response = do("/auth/webauthn/login/finish", "", assertion)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var session map[string]string
+	assert.NoError(t, json.NewDecoder(response.Body).Decode(&session))
+	login, err := service.Check(session["token"])
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", login)
+	assert.NotEmpty(t, response.Result().Cookies())
+
+	assert.Equal(t, http.StatusUnauthorized, do("/auth/webauthn/login/finish", "", assertion).Code)
+
+	service.WebAuthn = nil
+	assert.Equal(t, http.StatusNotImplemented, do("/auth/webauthn/login/begin", "", nil).Code)
+}